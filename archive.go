@@ -0,0 +1,163 @@
+package quickproto
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// WriteZip writes all files of the message to a zip archive.
+// The mode and modification time of files are stored, directory entries are stored as directories.
+func (m *Message) WriteZip(w io.Writer) error {
+	var zw = zip.NewWriter(w)
+	for _, file := range m.sortedFiles() {
+		var header = &zip.FileHeader{
+			Name:     file.Name,
+			Method:   zip.Deflate,
+			Modified: file.ModTime,
+		}
+		header.SetMode(archiveMode(file))
+		if file.IsDir() {
+			header.Name = strings.TrimSuffix(file.Name, "/") + "/"
+			header.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			continue
+		}
+		if err := file.copyTo(fw); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// WriteTar writes all files of the message to a tar archive.
+// The mode and modification time of files are stored, directory entries are stored as directories.
+func (m *Message) WriteTar(w io.Writer) error {
+	var tw = tar.NewWriter(w)
+	for _, file := range m.sortedFiles() {
+		var header = &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.Name,
+			Mode:     int64(archiveMode(file).Perm()),
+			ModTime:  file.ModTime,
+			Size:     int64(file.Size()),
+		}
+		if file.IsDir() {
+			header.Typeflag = tar.TypeDir
+			header.Name = strings.TrimSuffix(file.Name, "/") + "/"
+			header.Size = 0
+		} else if file.reader != nil {
+			return errors.New("file " + file.Name + " can only be read when the message is written")
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if file.IsDir() {
+			continue
+		}
+		if err := file.copyTo(tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// AddZip adds all entries of a zip archive to the message.
+// Files are read into memory, directories are added as directory entries.
+func (m *Message) AddZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range zr.File {
+		var file = &MessageFile{
+			Name:    strings.TrimSuffix(entry.Name, "/"),
+			Mode:    entry.Mode(),
+			ModTime: entry.Modified,
+		}
+		if !entry.Mode().IsDir() && !entry.Mode().IsRegular() {
+			continue
+		}
+		if !file.IsDir() {
+			rc, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			file.Data, err = io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		file.MimeType = detectMimeType(file.Name, file.Data)
+		m.AddFile(file)
+	}
+	return nil
+}
+
+// AddTar adds all entries of a tar archive to the message.
+// Files are read into memory, directories are added as directory entries.
+// Links and other special entries are skipped.
+func (m *Message) AddTar(r io.Reader) error {
+	var tr = tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var file = &MessageFile{
+			Name:    strings.TrimSuffix(header.Name, "/"),
+			Mode:    fs.FileMode(header.Mode).Perm(),
+			ModTime: header.ModTime,
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			file.Mode |= fs.ModeDir
+		case tar.TypeReg:
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, tr); err != nil {
+				return err
+			}
+			file.Data = buf.Bytes()
+		default:
+			continue
+		}
+		file.MimeType = detectMimeType(file.Name, file.Data)
+		m.AddFile(file)
+	}
+}
+
+// Get the files of the message sorted by name, so directories come before their contents.
+func (m *Message) sortedFiles() []*MessageFile {
+	var files = make([]*MessageFile, 0, len(m.Files))
+	for _, file := range m.Files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// Get the mode to store a file with in an archive.
+func archiveMode(file *MessageFile) fs.FileMode {
+	if file.Mode.Perm() != 0 {
+		return file.Mode
+	}
+	if file.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,137 @@
+package quickproto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Marks the whole-message checksum trailer, which is sent after the body:
+// body + TRAILER_DELIMITER + checksum + ENDING_DELIMITER, see Message.TrailerDelimiter.
+// Escaped data never contains the marker.
+const TRAILER_MARKER = "=S"
+
+// Algorithm used for the checksums of files and messages.
+type ChecksumAlgorithm string
+
+const (
+	// SHA-256, also protects against deliberate tampering, but hashing is several times slower than CRC-32.
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	// CRC-32 with the IEEE polynomial, the default. Only protects against accidental damage.
+	ChecksumCRC32 ChecksumAlgorithm = "crc32"
+	// Do not send checksums.
+	ChecksumNone ChecksumAlgorithm = NO_CHECKSUM
+)
+
+// A ChecksumError is returned when the data of a file, or a whole message, does not match its checksum.
+type ChecksumError struct {
+	// Name of the file, empty for the message checksum.
+	File     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.File == "" {
+		return "message checksum mismatch: expected " + e.Expected + ", got " + e.Actual
+	}
+	return "checksum mismatch for file " + e.File + ": expected " + e.Expected + ", got " + e.Actual
+}
+
+// Create a new hash for the algorithm, nil for ChecksumNone and unknown algorithms.
+func (a ChecksumAlgorithm) hash() hash.Hash {
+	switch a {
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumCRC32, "":
+		return crc32.NewIEEE()
+	}
+	return nil
+}
+
+// Format the sum of a hash as a checksum, formatted as "<algorithm>:<hex>".
+func (a ChecksumAlgorithm) format(h hash.Hash) string {
+	if a == "" {
+		a = ChecksumCRC32
+	}
+	return string(a) + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Compute the checksum of data, formatted as "<algorithm>:<hex>".
+// Returns NO_CHECKSUM for ChecksumNone.
+func (a ChecksumAlgorithm) sum(data []byte) string {
+	var h = a.hash()
+	if h == nil {
+		return NO_CHECKSUM
+	}
+	h.Write(data)
+	return a.format(h)
+}
+
+// Split the message checksum trailer from the body section of a message, without the ending delimiter.
+// Reports false if the message has no trailer.
+func (m *Message) splitTrailer(data []byte) ([]byte, string, bool, error) {
+	var trailer_delimiter = m.TrailerDelimiter()
+	var i = bytes.LastIndex(data, trailer_delimiter)
+	if i < 0 {
+		return data, "", false, nil
+	}
+	checksum, err := unescapeString(data[i+len(trailer_delimiter):])
+	if err != nil {
+		return nil, "", false, err
+	}
+	return data[:i], checksum, true, nil
+}
+
+// checksumReader verifies the checksum of a file when its data has been read to the end.
+type checksumReader struct {
+	r    io.Reader
+	file *MessageFile
+	alg  ChecksumAlgorithm
+	hash hash.Hash
+}
+
+// Create a reader verifying the checksum of the file.
+// Checksums of unknown algorithms are not verified.
+func newChecksumReader(r io.Reader, file *MessageFile) io.Reader {
+	alg, _, _ := strings.Cut(file.Checksum, ":")
+	var a = ChecksumAlgorithm(alg)
+	var h = a.hash()
+	if h == nil || alg == "" {
+		return r
+	}
+	return &checksumReader{r: r, file: file, alg: a, hash: h}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := c.alg.format(c.hash); actual != c.file.Checksum {
+			return n, &ChecksumError{File: c.file.Name, Expected: c.file.Checksum, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+// Verify data against a checksum formatted as "<algorithm>:<hex>".
+// Checksums of unknown algorithms are not verified.
+func verifyChecksum(file string, checksum string, data []byte) error {
+	alg, _, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return errors.New("invalid checksum " + checksum)
+	}
+	var a = ChecksumAlgorithm(alg)
+	if a.hash() == nil || alg == "" {
+		return nil
+	}
+	if actual := a.sum(data); actual != checksum {
+		return &ChecksumError{File: file, Expected: checksum, Actual: actual}
+	}
+	return nil
+}
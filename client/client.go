@@ -1,8 +1,13 @@
 package client
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Nigel2392/quickproto"
 	"github.com/Nigel2392/simplecrypto/aes"
@@ -17,7 +22,29 @@ type Client struct {
 	CONFIG    *quickproto.Config
 	OnMessage func(*quickproto.Message)
 	AesKey    *[32]byte
-	Cookies   map[string][]string
+	Cookies   quickproto.Header
+	// Maximum time Request waits for a response, when its context has no deadline.
+	// 0 means Request waits until its context is done.
+	RequestTimeout time.Duration
+	// Buffered reader for the connection, keeps data of messages which were sent back to back.
+	reader *bufio.Reader
+	// Guards Cookies and writes to the connection.
+	mu sync.Mutex
+	// Dispatcher of the current connection, reading messages for Request and Listen.
+	// Connect replaces it for every new connection.
+	dispatcher *dispatcher
+	dispatchMu sync.Mutex
+}
+
+// Reads the messages of one connection for Request and Listen.
+type dispatcher struct {
+	reader *bufio.Reader
+	start  sync.Once
+	done   chan struct{}
+	err    error
+	// Requests waiting for a response, by message ID.
+	pending   map[string]chan *quickproto.Message
+	pendingMu sync.Mutex
 }
 
 // Initiate a new client.
@@ -28,7 +55,7 @@ func New(ip string, port any, conf *quickproto.Config, onmessage func(*quickprot
 		Conn:      nil,
 		CONFIG:    conf,
 		OnMessage: onmessage,
-		Cookies:   make(map[string][]string),
+		Cookies:   make(quickproto.Header),
 	}
 }
 
@@ -49,6 +76,14 @@ func (c *Client) Connect(typ ...string) error {
 	} else {
 		c.Conn, err = net.Dial("tcp", c.Addr())
 	}
+	if err != nil {
+		return err
+	}
+	c.reader = quickproto.NewReader(c.Conn, c.CONFIG)
+	// Requests of a previous connection fail with its error, new requests use the new connection.
+	c.dispatchMu.Lock()
+	c.dispatcher = c.newDispatcher()
+	c.dispatchMu.Unlock()
 	if c.CONFIG.UseCrypto && c.AesKey == nil {
 		// Generate new aes key each session
 		aes_key := aes.NewEncryptionKey()
@@ -82,43 +117,151 @@ func (c *Client) Terminate() error {
 
 // Read a message from the server.
 func (c *Client) Read() (*quickproto.Message, error) {
-	msg, err := quickproto.ReadConn(c.Conn, c.CONFIG, c.AesKey, c.CONFIG.Compressed)
+	if c.reader == nil {
+		c.reader = quickproto.NewReader(c.Conn, c.CONFIG)
+	}
+	return c.readFrom(c.reader)
+}
+
+// Read a message from the reader of a connection, and apply the cookies it sets.
+func (c *Client) readFrom(r *bufio.Reader) (*quickproto.Message, error) {
+	msg, err := quickproto.ReadConn(r, c.CONFIG, c.AesKey, c.CONFIG.Compressed)
 	if err != nil {
 		return nil, err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for k, v := range msg.Headers {
-		if strings.HasPrefix(k, "Q-SET-COOKIES-") {
-			c.Cookies[strings.TrimPrefix(k, "Q-SET-COOKIES-")] = v
-		} else if strings.HasPrefix(k, "Q-DEL-COOKIES-") {
-			delete(c.Cookies, strings.TrimPrefix(k, "Q-DEL-COOKIES-"))
+		if strings.HasPrefix(k, quickproto.SET_COOKIES_PREFIX) {
+			c.Cookies[strings.TrimPrefix(k, quickproto.SET_COOKIES_PREFIX)] = v
+		} else if strings.HasPrefix(k, quickproto.DEL_COOKIES_PREFIX) {
+			c.Cookies.Del(strings.TrimPrefix(k, quickproto.DEL_COOKIES_PREFIX))
 		}
 	}
 	return msg, nil
 }
 
 // Write a message to the server.
+// The message gets a message ID if it has none.
+// It is safe to call Write from multiple goroutines.
 func (c *Client) Write(msg *quickproto.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msg.EnsureID()
 	for k, v := range c.Cookies {
 		for _, v2 := range v {
-			msg.AddHeader("Q-COOKIES-"+k, v2)
+			msg.AddHeader(quickproto.COOKIES_PREFIX+k, v2)
 		}
 	}
+	msg.Framing = c.CONFIG.Framing
 	return quickproto.WriteConn(c.Conn, msg, c.AesKey, c.CONFIG.Compressed)
 }
 
-// Listen for messages from the server.
+// Listen for messages from the server, and pass them to OnMessage.
+// Responses to requests made with Request are not passed to OnMessage.
+// Listen returns when reading from the connection fails.
 func (c *Client) Listen() error {
-	for {
-		msg, err := c.Read()
-		if err != nil {
-			return err
+	var d = c.startDispatch()
+	<-d.done
+	return d.err
+}
+
+// Request sends a message to the server, and waits for the response to it.
+// The response is the first message of which the correlation ID is the ID of the request.
+//
+// Request returns when the response arrives, the context is done, RequestTimeout passes,
+// or reading from the connection fails. A response which arrives later is passed to OnMessage.
+// Other messages are passed to OnMessage while waiting, as with Listen.
+func (c *Client) Request(ctx context.Context, msg *quickproto.Message) (*quickproto.Message, error) {
+	if _, ok := ctx.Deadline(); !ok && c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+	var d = c.startDispatch()
+	var id = msg.EnsureID()
+	var response = make(chan *quickproto.Message, 1)
+	d.pendingMu.Lock()
+	d.pending[id] = response
+	d.pendingMu.Unlock()
+	defer func() {
+		d.pendingMu.Lock()
+		delete(d.pending, id)
+		d.pendingMu.Unlock()
+	}()
+	if err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-response:
+		return resp, nil
+	case <-d.done:
+		// The response may have arrived right before the connection failed.
+		select {
+		case resp := <-response:
+			return resp, nil
+		default:
+		}
+		if d.err == nil {
+			return nil, errors.New("connection closed")
 		}
-		c.OnMessage(msg)
+		return nil, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Create the dispatcher for the current connection.
+func (c *Client) newDispatcher() *dispatcher {
+	if c.reader == nil {
+		c.reader = quickproto.NewReader(c.Conn, c.CONFIG)
 	}
+	return &dispatcher{
+		reader:  c.reader,
+		done:    make(chan struct{}),
+		pending: make(map[string]chan *quickproto.Message),
+	}
+}
+
+// Start the dispatcher of the current connection, which reads messages until reading fails.
+// Responses are sent to the waiting request, other messages to OnMessage.
+func (c *Client) startDispatch() *dispatcher {
+	c.dispatchMu.Lock()
+	if c.dispatcher == nil {
+		c.dispatcher = c.newDispatcher()
+	}
+	var d = c.dispatcher
+	c.dispatchMu.Unlock()
+	d.start.Do(func() {
+		go func() {
+			defer close(d.done)
+			for {
+				msg, err := c.readFrom(d.reader)
+				if err != nil {
+					d.err = err
+					return
+				}
+				if id := msg.CorrelationID(); id != "" {
+					d.pendingMu.Lock()
+					response, ok := d.pending[id]
+					delete(d.pending, id)
+					d.pendingMu.Unlock()
+					if ok {
+						response <- msg
+						continue
+					}
+				}
+				if c.OnMessage != nil {
+					c.OnMessage(msg)
+				}
+			}
+		}()
+	})
+	return d
 }
 
 func (c *Client) GetCookies(key string) []string {
-	values, ok := c.Cookies[key]
+	values, ok := c.Cookies[quickproto.CanonicalHeaderKey(key)]
 	if !ok {
 		return nil
 	}
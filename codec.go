@@ -0,0 +1,134 @@
+package quickproto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Header which holds the content type of the body.
+const CONTENT_TYPE_HEADER = "content-type"
+
+// A Codec marshals values into a message body, and unmarshals them again.
+type Codec interface {
+	// The content type which is sent in the content-type header.
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Codecs from the standard library.
+// These are registered by default.
+var (
+	JSONCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+	XMLCodec  Codec = xmlCodec{}
+)
+
+// Codec used by SetBodyValue when the message has no codec.
+var DefaultCodec = JSONCodec
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: make(map[string]Codec)}
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(GobCodec)
+	RegisterCodec(XMLCodec)
+}
+
+// RegisterCodec registers a codec for its content type.
+// A codec registered earlier for the same content type is replaced.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[mediaType(c.ContentType())] = c
+}
+
+// GetCodec returns the codec registered for a content type.
+// Parameters of the content type, like "; charset=utf-8", are ignored.
+func GetCodec(content_type string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[mediaType(content_type)]
+	return c, ok
+}
+
+// Strip the parameters from a content type.
+func mediaType(content_type string) string {
+	media, _, _ := strings.Cut(content_type, ";")
+	return strings.ToLower(strings.TrimSpace(media))
+}
+
+// SetBodyValue marshals v into the body, with the codec of the message.
+// DefaultCodec is used if the message has no codec.
+// The content-type header is set to the content type of the codec.
+func (m *Message) SetBodyValue(v any) error {
+	if m.Codec == nil {
+		m.Codec = DefaultCodec
+	}
+	data, err := m.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.Body = data
+	m.Headers.Set(CONTENT_TYPE_HEADER, m.Codec.ContentType())
+	return nil
+}
+
+// DecodeBody unmarshals the body into v.
+// The codec of the message is used, or the codec registered for the content-type header.
+func (m *Message) DecodeBody(v any) error {
+	var codec = m.Codec
+	if codec == nil {
+		var ok bool
+		var content_type = m.Headers.Get(CONTENT_TYPE_HEADER)
+		if codec, ok = GetCodec(content_type); !ok {
+			return errors.New("no codec registered for content type \"" + content_type + "\"")
+		}
+	}
+	return codec.Unmarshal(m.Body, v)
+}
+
+// Set the codec of a parsed message from its content-type header.
+func (m *Message) detectCodec() {
+	if content_type := m.Headers.Get(CONTENT_TYPE_HEADER); content_type != "" {
+		if codec, ok := GetCodec(content_type); ok {
+			m.Codec = codec
+		}
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type xmlCodec struct{}
+
+func (xmlCodec) ContentType() string                { return "application/xml" }
+func (xmlCodec) Marshal(v any) ([]byte, error)      { return xml.Marshal(v) }
+func (xmlCodec) Unmarshal(data []byte, v any) error { return xml.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/x-gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
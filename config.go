@@ -23,6 +23,28 @@ type Config struct {
 	PublicKey  *rsa.PublicKey  // Client-side.
 	// Compress the messages
 	Compressed bool
+	// How messages are framed on the wire, defaults to FramingDelimiter.
+	Framing Framing
+	// Maximum size of a length framed message.
+	// 0 means DEFAULT_MAX_FRAME_SIZE, a negative size means no limit.
+	MaxFrameSize int64
+	// Escape the delimiter in headers, filenames, files and the body.
+	Escape bool
+	// Copy the body and files of parsed messages, instead of slicing them from the received data.
+	OwnedCopy bool
+	// Received files larger than SpillThreshold bytes are written to a temporary file in SpillDir.
+	// 0 means files are never spilled. ReadConn streams messages which are not encrypted or compressed
+	// to disk when this is set, see Message.SpillThreshold.
+	SpillThreshold int64
+	SpillDir       string
+	// Checksums of files and messages, see Message.ChecksumAlgorithm and Message.MessageChecksum.
+	ChecksumAlgorithm ChecksumAlgorithm
+	MessageChecksum   bool
+	// Codec of message bodies, see Message.SetBodyValue.
+	Codec Codec
+	// Name of the encoding for files which contain the delimiter, see RegisterFileEncoding.
+	// Defaults to DEFAULT_FILE_ENCODING.
+	FileEncoding string
 }
 
 // NewConfig creates a new Config.
@@ -47,5 +69,17 @@ func NewConfig(delimiter []byte, useencoding bool, usecrypto bool, bufsize int,
 
 // Generate a new message with default configuration options.
 func (c *Config) NewMessage() *Message {
-	return NewMessage(c.Delimiter, c.UseEncoding, c.Encode_func, c.Decode_func)
+	var msg = NewMessage(c.Delimiter, c.UseEncoding, c.Encode_func, c.Decode_func)
+	msg.Framing = c.Framing
+	msg.Escape = c.Escape
+	msg.OwnedCopy = c.OwnedCopy
+	msg.Codec = c.Codec
+	msg.SpillThreshold = c.SpillThreshold
+	msg.SpillDir = c.SpillDir
+	msg.ChecksumAlgorithm = c.ChecksumAlgorithm
+	msg.MessageChecksum = c.MessageChecksum
+	if c.FileEncoding != "" {
+		msg.FileEncoding = c.FileEncoding
+	}
+	return msg
 }
@@ -1,7 +1,10 @@
 package quickproto
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"io"
 	"net"
 	"strconv"
 
@@ -21,59 +24,133 @@ func CraftAddr(ip string, port any) string {
 	}
 }
 
+// NewReader creates a buffered reader for a connection, to pass to ReadConn.
+// Data read past the end of a message is kept in the reader for the next call to ReadConn,
+// so one reader should be used for all reads from the same connection.
+// The buffer is at least as large as the buffer of a Decoder, so ReadConn can decode from it directly.
+func NewReader(conn net.Conn, conf *Config) *bufio.Reader {
+	return bufio.NewReaderSize(conn, decoderBufSize(conf))
+}
+
 // ReadConn reads a message from a connection.
-func ReadConn(conn net.Conn, conf *Config, aes_key *[32]byte, compress bool) (*Message, error) {
+// Length framed messages are read straight from the connection, so no data of the next message is consumed.
+// With delimiter framing, pass a reader created with NewReader to keep data of messages which were sent directly after this one.
+// Any other reader is buffered for this call only, and data read past the end of the message is lost.
+//
+// When conf.SpillThreshold is set, messages which are not encrypted or compressed are read with a Decoder,
+// so files larger than the threshold are written to disk without holding the whole message in memory.
+func ReadConn(conn io.Reader, conf *Config, aes_key *[32]byte, compress bool) (*Message, error) {
+	if conf.Framing == FramingLength {
+		return readLengthFramed(conn, conf, aes_key)
+	}
+	r, ok := conn.(*bufio.Reader)
+	if !ok {
+		r = bufio.NewReaderSize(conn, decoderBufSize(conf))
+	}
+	if conf.SpillThreshold > 0 && aes_key == nil && !compress {
+		return NewDecoder(r, conf).Decode()
+	}
 	msg := conf.NewMessage()
-	buf := make([]byte, conf.BufSize)
-	var data []byte
+	ending_delimiter := msg.EndingDelimiter()
 	// read until ending delimiter is found.
-	for !bytes.Contains(data, msg.EndingDelimiter()) {
-		// read data from connection.
-		n, err := conn.Read(buf)
-		if err != nil {
-			return nil, err
-		}
-		data = append(data, buf[:n]...)
-		// flush buffer.
+	data, err := readDelimited(r, ending_delimiter)
+	if err != nil {
+		return nil, err
 	}
 	// decrypt data if needed.
 	if compress {
-		data = bytes.TrimSuffix(data, msg.EndingDelimiter())
-		var err error
+		data = bytes.TrimSuffix(data, ending_delimiter)
 		data, err = GZIPdecompress(data)
 		if err != nil {
 			return nil, err
 		}
 	}
 	if aes_key != nil {
-		var err error
 		if !compress {
-			data = bytes.TrimSuffix(data, msg.EndingDelimiter())
+			data = bytes.TrimSuffix(data, ending_delimiter)
 		}
 		if data, err = aes.Decrypt(data, aes_key); err != nil {
 			return nil, err
 		}
-		data = append(data, msg.EndingDelimiter()...)
+		data = append(data, ending_delimiter...)
 	}
 	msg.Data = data
 	return msg.Parse()
 }
 
+// Read from r up to and including the first occurrence of the delimiter.
+// Bytes after the delimiter are left in the reader.
+//
+// Only newly read bytes are searched for the delimiter, together with the last len(delimiter)-1 bytes
+// of the previous read, in case the delimiter was split over two reads.
+// The buffer for the data grows geometrically.
+func readDelimited(r *bufio.Reader, delimiter []byte) ([]byte, error) {
+	var data = make([]byte, 0, r.Size())
+	for {
+		// Wait for data if nothing is buffered.
+		if _, err := r.Peek(1); err != nil {
+			if err == io.EOF && len(data) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buf, _ := r.Peek(r.Buffered())
+		if cap(data)-len(data) < len(buf) {
+			var newcap = cap(data) * 2
+			for newcap < len(data)+len(buf) {
+				newcap = newcap * 2
+			}
+			var grown = make([]byte, len(data), newcap)
+			copy(grown, data)
+			data = grown
+		}
+		var start = len(data)
+		data = append(data, buf...)
+		var from = start - len(delimiter) + 1
+		if from < 0 {
+			from = 0
+		}
+		if i := bytes.Index(data[from:], delimiter); i >= 0 {
+			var end = from + i + len(delimiter)
+			// Only consume the message, the rest belongs to the next one.
+			if _, err := r.Discard(end - start); err != nil {
+				return nil, err
+			}
+			return data[:end], nil
+		}
+		if _, err := r.Discard(len(buf)); err != nil {
+			return nil, err
+		}
+	}
+}
+
 // WriteConn writes a message to a connection and encrypts it if needed.
+// The message is framed according to msg.Framing.
+//
+// When the message is not encrypted or compressed, and sent over a stream connection,
+// it is written directly to the connection with msg.WriteTo; msg.Data is not set in that case.
 func WriteConn(conn net.Conn, msg *Message, aes_key *[32]byte, compress bool) error {
+	if msg.Framing == FramingLength {
+		return writeLengthFramed(conn, msg, aes_key, compress)
+	}
+	// Packet connections need the whole message in a single write.
+	if _, ok := conn.(net.PacketConn); !ok && aes_key == nil && !compress {
+		return NewEncoder(conn).Encode(msg)
+	}
 	// Write data to connection.
 	send, err := msg.Generate()
 	if err != nil {
 		return err
 	}
+	ending_delimiter := msg.EndingDelimiter()
 	if aes_key != nil {
-		send.Data = bytes.TrimSuffix(send.Data, msg.EndingDelimiter())
+		send.Data = bytes.TrimSuffix(send.Data, ending_delimiter)
 		send.Data, err = aes.Encrypt(send.Data, aes_key)
 		if err != nil {
 			return err
 		}
 		if !compress {
-			send.Data = append(send.Data, msg.EndingDelimiter()...)
+			send.Data = append(send.Data, ending_delimiter...)
 		}
 	}
 	if compress {
@@ -81,7 +158,7 @@ func WriteConn(conn net.Conn, msg *Message, aes_key *[32]byte, compress bool) er
 		if err != nil {
 			return err
 		}
-		send.Data = append(send.Data, msg.EndingDelimiter()...)
+		send.Data = append(send.Data, ending_delimiter...)
 	}
 	_, err = conn.Write(send.Data)
 	if err != nil {
@@ -89,3 +166,72 @@ func WriteConn(conn net.Conn, msg *Message, aes_key *[32]byte, compress bool) er
 	}
 	return nil
 }
+
+// Read a length framed message from a connection.
+// The flags in the frame header decide whether the payload gets decompressed and decrypted.
+func readLengthFramed(r io.Reader, conf *Config, aes_key *[32]byte) (*Message, error) {
+	flags, length, err := readFrameHeader(r, conf.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	if conf.SpillThreshold > 0 && flags == 0 {
+		// Decode the payload while it is read, the decoder never reads past the frame.
+		var payload = io.LimitReader(r, length)
+		msg, err := NewDecoder(payload, conf).Decode()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			msg.Close()
+			return nil, err
+		}
+		return msg, nil
+	}
+	data, err := readFramePayload(r, length)
+	if err != nil {
+		return nil, err
+	}
+	if flags&frameCompressed != 0 {
+		if data, err = GZIPdecompress(data); err != nil {
+			return nil, err
+		}
+	}
+	if flags&frameEncrypted != 0 {
+		if aes_key == nil {
+			return nil, errors.New("received encrypted frame without aes key")
+		}
+		if data, err = aes.Decrypt(data, aes_key); err != nil {
+			return nil, err
+		}
+	}
+	msg := conf.NewMessage()
+	msg.Data = data
+	return msg.Parse()
+}
+
+// Write a length framed message to a connection.
+// The message is encrypted first, and compressed afterwards, like with delimiter framing.
+func writeLengthFramed(conn net.Conn, msg *Message, aes_key *[32]byte, compress bool) error {
+	send, err := msg.Generate()
+	if err != nil {
+		return err
+	}
+	var data = send.Data
+	var flags byte
+	if aes_key != nil {
+		if data, err = aes.Encrypt(data, aes_key); err != nil {
+			return err
+		}
+		flags |= frameEncrypted
+	}
+	if compress {
+		if data, err = GZIPcompress(data); err != nil {
+			return err
+		}
+		flags |= frameCompressed
+	}
+	return writeFrame(conn, flags, data)
+}
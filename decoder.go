@@ -0,0 +1,561 @@
+package quickproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// States of the decoder.
+const (
+	decodeStart = iota
+	decodeHeaders
+	decodeParts
+	decodeDone
+)
+
+// A Decoder reads messages from an input stream, without keeping the whole message in memory.
+// Headers are returned as soon as they are read, the body and files are returned as parts,
+// which can be read like any other io.Reader.
+//
+// The decoder uses the same delimiters as Message.Parse.
+// When the message body is encoded with Encode_func, the body and files have to be decoded
+// as a whole, and are kept in memory.
+//
+// The checksums of files are verified when their part has been read to the end.
+// A message checksum trailer is removed from the body, but not verified; use Message.Parse for that.
+//
+// Multiple messages can be read from the same stream, one after the other.
+type Decoder struct {
+	// Underlying reader, as passed to NewDecoder.
+	base *bufio.Reader
+	// Reader used for the current message.
+	r    *bufio.Reader
+	conf *Config
+	// Message template, holding delimiters and encoding functions.
+	tmpl *Message
+	// Predefined delimiters.
+	header_delimiter []byte
+	file_delimiter   []byte
+	ending_delimiter []byte
+	// Current state of the decoder.
+	state   int
+	escaped bool
+	part    *Part
+}
+
+// A Part is a file, or the body of a message read by a Decoder.
+// A part is only valid until the next call to NextPart, NextHeader or Decode.
+type Part struct {
+	// Name of the file, empty for the body.
+	Name string
+	// Is this part the body of the message?
+	IsBody bool
+	// Metadata of the file, without its data. Nil for the body.
+	File *MessageFile
+	r    io.Reader
+}
+
+// Read the data of the part.
+func (p *Part) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+// NewDecoder creates a new Decoder reading from r.
+// If r is a *bufio.Reader with a large enough buffer, it is used directly,
+// so no data is read past the end of the last decoded message.
+func NewDecoder(r io.Reader, conf *Config) *Decoder {
+	var tmpl = conf.NewMessage()
+	var ending_delimiter = tmpl.EndingDelimiter()
+	var br = bufio.NewReaderSize(r, decoderBufSize(conf))
+	return &Decoder{
+		base:             br,
+		r:                br,
+		conf:             conf,
+		tmpl:             tmpl,
+		header_delimiter: tmpl.HeaderDelimiter(),
+		file_delimiter:   tmpl.FileDelimiter(),
+		ending_delimiter: ending_delimiter,
+	}
+}
+
+// Size of the buffer of a decoder, file headers have to fit in it.
+// Buffered readers of at least this size are used by the decoder as they are.
+func decoderBufSize(conf *Config) int {
+	var size = conf.BufSize
+	if size < 4096 {
+		size = 4096
+	}
+	if n := len(conf.NewMessage().EndingDelimiter()) * 4; size < n {
+		size = n
+	}
+	return size
+}
+
+// NextHeader returns the next header of the current message.
+// It returns io.EOF when all headers have been read, or when the stream ends before a new message.
+// When the previous message was fully read, NextHeader starts reading the next one.
+func (d *Decoder) NextHeader() (string, []string, error) {
+	if d.state == decodeDone {
+		d.reset()
+	}
+	if d.state == decodeStart {
+		if _, err := d.r.Peek(1); err != nil {
+			return "", nil, err
+		}
+		marker := append([]byte(ESCAPE_MARKER), d.tmpl.Delimiter...)
+		if peek, _ := d.r.Peek(len(marker)); bytes.Equal(peek, marker) {
+			d.escaped = true
+		}
+		d.state = decodeHeaders
+	}
+	if d.state != decodeHeaders {
+		return "", nil, io.EOF
+	}
+	for {
+		// Headers end with an empty header line.
+		if ok, err := d.skip(d.header_delimiter); err != nil {
+			return "", nil, err
+		} else if ok {
+			d.state = decodeParts
+			return "", nil, io.EOF
+		}
+		line, err := io.ReadAll(d.until(d.header_delimiter))
+		if err != nil {
+			return "", nil, err
+		}
+		head := bytes.Split(line, d.tmpl.Delimiter)
+		if len(head) < 2 {
+			return "", nil, errors.New("invalid header key value sent")
+		}
+		if d.escaped && string(head[0]) == ESCAPE_MARKER {
+			var version = make([]string, 0, len(head)-1)
+			for _, v := range head[1:] {
+				version = append(version, string(v))
+			}
+			if err := checkEscapeVersion(version); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		key, err := d.unescapeHeader(head[0])
+		if err != nil {
+			return "", nil, err
+		}
+		values := make([]string, 0, len(head)-1)
+		for _, v := range head[1:] {
+			value, err := d.unescapeHeader(v)
+			if err != nil {
+				return "", nil, err
+			}
+			values = append(values, value)
+		}
+		return key, values, nil
+	}
+}
+
+// NextPart returns the next file, or the body of the current message.
+// Any headers which were not read yet are skipped.
+// It returns io.EOF after the body has been returned.
+func (d *Decoder) NextPart() (*Part, error) {
+	for d.state == decodeStart || d.state == decodeHeaders {
+		if _, _, err := d.NextHeader(); err == io.EOF {
+			if d.state != decodeParts {
+				return nil, io.EOF
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if d.state != decodeParts {
+		return nil, io.EOF
+	}
+	if d.part == nil {
+		// First part, decode the body if needed.
+		if err := d.decodeBody(); err != nil {
+			return nil, err
+		}
+	} else {
+		// Skip the rest of the previous part.
+		if _, err := io.Copy(io.Discard, d.part); err != nil {
+			return nil, err
+		}
+		if d.part.IsBody {
+			d.finish()
+			return nil, io.EOF
+		}
+	}
+	file, flag, ok, err := d.fileHeader()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		d.part, err = d.bodyPart()
+		return d.part, err
+	}
+	d.part, err = d.filePart(file, flag)
+	return d.part, err
+}
+
+// Decode reads the next complete message from the stream.
+// It returns io.EOF if the stream ends before a new message.
+func (d *Decoder) Decode() (*Message, error) {
+	if d.state != decodeStart && d.state != decodeDone {
+		return nil, errors.New("decoder is in the middle of a message")
+	}
+	var msg = d.conf.NewMessage()
+	for {
+		key, values, err := d.NextHeader()
+		if err == io.EOF {
+			if d.state != decodeParts {
+				return nil, io.EOF
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		msg.Headers[CanonicalHeaderKey(key)] = values
+	}
+	msg.detectCodec()
+	for {
+		part, err := d.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// Remove files which were already spilled to disk.
+			msg.Close()
+			return nil, err
+		}
+		if part.IsBody {
+			if msg.Body, err = io.ReadAll(part); err != nil {
+				msg.Close()
+				return nil, err
+			}
+			continue
+		}
+		if err = part.File.readData(part, msg.SpillThreshold, msg.SpillDir); err != nil {
+			msg.Close()
+			return nil, err
+		}
+		if old, ok := msg.Files[part.Name]; ok {
+			// A file with the same name replaces the earlier one.
+			old.removeTemp()
+		}
+		msg.Files[part.Name] = part.File
+	}
+	return msg, nil
+}
+
+// Reset the decoder for the next message.
+func (d *Decoder) reset() {
+	d.state = decodeStart
+	d.escaped = false
+	d.part = nil
+}
+
+// Finish the current message.
+func (d *Decoder) finish() {
+	d.state = decodeDone
+	d.part = nil
+	d.r = d.base
+}
+
+// Consume the delimiter if the stream continues with it.
+func (d *Decoder) skip(delimiter []byte) (bool, error) {
+	peek, err := d.r.Peek(len(delimiter))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, err
+	}
+	if !bytes.Equal(peek, delimiter) {
+		return false, nil
+	}
+	_, err = d.r.Discard(len(delimiter))
+	return true, err
+}
+
+// Returns a reader for all data up to the delimiter.
+func (d *Decoder) until(delimiter []byte) io.Reader {
+	return &untilReader{r: d.r, delimiter: delimiter}
+}
+
+// Unescape a header key or value if the message is escaped.
+func (d *Decoder) unescapeHeader(b []byte) (string, error) {
+	if !d.escaped {
+		return string(b), nil
+	}
+	return unescapeHeaderString(b)
+}
+
+// Read the body and files into memory when the body is encoded, and decode them.
+// The decoded data is read as if it were sent without encoding.
+func (d *Decoder) decodeBody() error {
+	if d.tmpl.Encode_func == nil || d.tmpl.Decode_func == nil || !d.tmpl.UseEncoding {
+		return nil
+	}
+	data, err := io.ReadAll(d.until(d.ending_delimiter))
+	if err != nil {
+		return err
+	}
+	// The message checksum trailer is sent after the encoded data.
+	if data, _, _, err = d.tmpl.splitTrailer(data); err != nil {
+		return err
+	}
+	if data, err = d.tmpl.Decode_func(data); err != nil {
+		return err
+	}
+	d.r = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(data), bytes.NewReader(d.ending_delimiter)), d.base.Size())
+	return nil
+}
+
+// Check if the next part is a file, and read the filename, metadata and encoding flag.
+// Files start with: filename + metadata + HEADER_DELIMITER + is_encoded + HEADER_DELIMITER.
+// The file header has to fit in the buffer of the decoder.
+//
+// Like Parse, a part which ends at the ending delimiter is the body, also when it starts like a file header.
+// When neither a file delimiter nor the ending delimiter fits in the buffer, the part is a file if it starts
+// with a file header, so an unescaped body larger than the buffer which looks like a file header is not
+// read the way Parse reads it.
+func (d *Decoder) fileHeader() (*MessageFile, string, bool, error) {
+	var hlen = len(d.header_delimiter)
+	var n = len(d.ending_delimiter)
+	for {
+		peek, err := d.r.Peek(n)
+		if err != nil && err != io.EOF {
+			return nil, "", false, err
+		}
+		// The part ends at the first file delimiter, the file header has to be before it.
+		var end = bytes.Index(peek, d.file_delimiter)
+		if end >= 0 && len(peek) < end+len(d.ending_delimiter) && err == nil && end+len(d.ending_delimiter) <= d.r.Size() {
+			// The file delimiter may be the start of the ending delimiter.
+			// Either way at least the length of the ending delimiter follows, so this never blocks.
+			n = end + len(d.ending_delimiter)
+			continue
+		}
+		if end >= 0 && bytes.HasPrefix(peek[end:], d.ending_delimiter) {
+			// The part is the body.
+			return nil, "", false, nil
+		}
+		var i = bytes.Index(peek, d.header_delimiter)
+		if i == 0 {
+			// Left over of an ending delimiter, after a file.
+			return nil, "", false, errors.New("invalid file sent")
+		}
+		if i > 0 && (end < 0 || i < end) {
+			var j = bytes.Index(peek[i+hlen:], d.header_delimiter)
+			if j >= 0 && (end < 0 || i+hlen+j < end) {
+				var flag = peek[i+hlen : i+hlen+j]
+				if !d.tmpl.isFileFlag(flag) {
+					return nil, "", false, nil
+				}
+				file, err := parseFileNameField(peek[:i], d.tmpl.Delimiter, d.escaped)
+				if err != nil {
+					return nil, "", false, err
+				}
+				var f = string(flag)
+				_, err = d.r.Discard(i + hlen + j + hlen)
+				return file, f, true, err
+			}
+		}
+		if end >= 0 || err != nil || n == d.r.Size() {
+			return nil, "", false, nil
+		}
+		// No file delimiter was found, so the message is at least HEADER_DELIMITER + 1 bytes longer.
+		// Never peek further than that, or we could block on data which is never sent.
+		n = n + hlen + 1
+		if d.r.Buffered() > n {
+			n = d.r.Buffered()
+		}
+		if n > d.r.Size() {
+			n = d.r.Size()
+		}
+	}
+}
+
+// Create the part for a file.
+func (d *Decoder) filePart(file *MessageFile, flag string) (*Part, error) {
+	// A single NULL byte is sent when the file is empty.
+	// The file delimiter and at least the ending delimiter follow, so this never blocks.
+	var empty = append([]byte{0x00}, d.file_delimiter...)
+	if peek, _ := d.r.Peek(len(empty)); bytes.Equal(peek, empty) {
+		if _, err := d.r.Discard(1); err != nil {
+			return nil, err
+		}
+		flag = "false"
+	}
+	decode, err := d.tmpl.fileDecoder(flag)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = d.until(d.file_delimiter)
+	if decode != nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decode(data); err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	} else if d.escaped {
+		r = &unescapeReader{r: r}
+	}
+	if file.Checksum != "" {
+		r = newChecksumReader(r, file)
+	}
+	return &Part{Name: file.Name, File: file, r: r}, nil
+}
+
+// Create the part for the body.
+func (d *Decoder) bodyPart() (*Part, error) {
+	// A single NULL byte is sent when the body is empty.
+	// Only peek past the ending delimiter or the trailer when the body starts with a NULL byte.
+	var trailer = d.tmpl.TrailerDelimiter()
+	if peek, err := d.r.Peek(1); err != nil {
+		return nil, err
+	} else if peek[0] == 0x00 {
+		for _, end := range [][]byte{d.ending_delimiter, trailer} {
+			var empty = append([]byte{0x00}, end...)
+			if peek, _ := d.r.Peek(len(empty)); bytes.Equal(peek, empty) {
+				if _, err := d.r.Discard(1); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	// The body ends at the message checksum trailer, if it is sent.
+	var r io.Reader = &untilReader{r: d.r, delimiter: d.ending_delimiter, trailer: trailer}
+	if d.escaped {
+		r = &unescapeReader{r: r}
+	}
+	return &Part{IsBody: true, r: r}, nil
+}
+
+// Check if the flag of a file header is valid.
+func (m *Message) isFileFlag(flag []byte) bool {
+	_, err := m.fileDecoder(string(flag))
+	return err == nil
+}
+
+// untilReader reads from a buffered reader until the delimiter is found.
+// The delimiter is consumed, but not returned.
+// When the trailer is set, data from the trailer up to the delimiter is consumed, but not returned.
+type untilReader struct {
+	r         *bufio.Reader
+	delimiter []byte
+	trailer   []byte
+	done      bool
+}
+
+func (u *untilReader) Read(p []byte) (int, error) {
+	if u.done {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Make sure the delimiter could be in the buffer.
+	if _, err := u.r.Peek(len(u.delimiter)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	buf, _ := u.r.Peek(u.r.Buffered())
+	var i = bytes.Index(buf, u.delimiter)
+	if u.trailer != nil {
+		var end = len(buf)
+		if i >= 0 {
+			end = i
+		}
+		if j := bytes.Index(buf[:end], u.trailer); j == 0 {
+			// Skip the trailer.
+			u.done = true
+			_, err := io.Copy(io.Discard, &untilReader{r: u.r, delimiter: u.delimiter})
+			return 0, err
+		} else if j > 0 {
+			i = j
+		} else if i < 0 {
+			// Keep enough bytes to find a trailer split over two reads.
+			var keep = len(u.trailer) - 1
+			if len(u.delimiter) > len(u.trailer) {
+				keep = len(u.delimiter) - 1
+			}
+			if len(buf) <= keep {
+				// The delimiter was not found, so more data follows.
+				if _, err := u.r.Peek(len(buf) + 1); err != nil && err != bufio.ErrBufferFull {
+					if err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					return 0, err
+				}
+				return u.Read(p)
+			}
+			buf = buf[:len(buf)-keep]
+			i = len(buf)
+		}
+	}
+	if i >= 0 {
+		if i == 0 {
+			u.done = true
+			_, err := u.r.Discard(len(u.delimiter))
+			return 0, err
+		}
+		buf = buf[:i]
+	} else {
+		// Keep enough bytes to find a delimiter split over two reads.
+		buf = buf[:len(buf)-len(u.delimiter)+1]
+	}
+	n := copy(p, buf)
+	_, err := u.r.Discard(n)
+	return n, err
+}
+
+// unescapeReader unescapes data escaped with escape() while reading.
+type unescapeReader struct {
+	r       io.Reader
+	buf     []byte
+	scratch [4096]byte
+	err     error
+}
+
+func (u *unescapeReader) Read(p []byte) (int, error) {
+	for {
+		var n, i int
+		for i < len(u.buf) && n < len(p) {
+			if u.buf[i] != ESCAPE_BYTE {
+				p[n] = u.buf[i]
+				n++
+				i++
+				continue
+			}
+			if len(u.buf)-i < 3 {
+				break
+			}
+			hi, lo := u.buf[i+1]-'A', u.buf[i+2]-'A'
+			if hi > 0x0f || lo > 0x0f {
+				return n, errors.New("invalid escape sequence")
+			}
+			p[n] = hi<<4 | lo
+			n++
+			i += 3
+		}
+		u.buf = append(u.buf[:0], u.buf[i:]...)
+		if n > 0 || len(p) == 0 {
+			return n, nil
+		}
+		if u.err != nil {
+			if u.err == io.EOF && len(u.buf) > 0 {
+				return 0, errors.New("invalid escape sequence")
+			}
+			return 0, u.err
+		}
+		m, err := u.r.Read(u.scratch[:])
+		u.buf = append(u.buf, u.scratch[:m]...)
+		u.err = err
+	}
+}
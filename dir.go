@@ -0,0 +1,88 @@
+package quickproto
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// AddDir adds all files in a directory tree to the message.
+// Files are named by their path relative to root, with forward slashes, and are streamed from disk
+// when the message is written. Directories, including empty ones, are added as entries without data,
+// so their modes are kept. Symlinks and other special files are skipped.
+//
+// Use Message.SaveAll to recreate the tree on the receiving side.
+func (m *Message) AddDir(root string) error {
+	return filepath.WalkDir(root, func(file_path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file_path)
+		if err != nil || rel == "." {
+			return err
+		}
+		var name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			return m.addDirEntry(name, d)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		file, err := NewMessageFileFromPath(file_path)
+		if err != nil {
+			return err
+		}
+		file.Name = name
+		m.AddFile(file)
+		return nil
+	})
+}
+
+// AddFS adds all files in a file system to the message, like AddDir.
+// Files are opened from the file system when the message is written.
+func (m *Message) AddFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		if d.IsDir() {
+			return m.addDirEntry(name, d)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		m.AddFile(&MessageFile{
+			Name:     name,
+			MimeType: detectMimeType(path.Base(name), nil),
+			Mode:     info.Mode(),
+			ModTime:  info.ModTime(),
+			open: func() (io.ReadCloser, error) {
+				return fsys.Open(name)
+			},
+			size: info.Size(),
+		})
+		return nil
+	})
+}
+
+// Add a directory entry to the message.
+func (m *Message) addDirEntry(name string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	m.AddFile(&MessageFile{
+		Name:     name,
+		MimeType: DEFAULT_MIME_TYPE,
+		Mode:     os.ModeDir | info.Mode().Perm(),
+		ModTime:  info.ModTime(),
+		Data:     []byte{},
+	})
+	return nil
+}
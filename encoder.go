@@ -0,0 +1,402 @@
+package quickproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Files which are read from an io.Reader are encoded in chunks of this size.
+// The size is a multiple of 3, 5 and 2, so chunks encoded with Base64Encoding,
+// Base32Encoding or Base16Encoding are equal to the encoding of the whole file.
+const FILE_CHUNK_SIZE = 15 * 4096
+
+// An Encoder writes messages to an output stream.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder creates a new Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode writes the message to the stream, and flushes it.
+func (e *Encoder) Encode(m *Message) error {
+	if _, err := m.WriteTo(e.w); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// WriteTo writes the message to w, in the same format as Generate.
+// Headers, files and the body are written directly to w, without building the message in memory.
+// When the body is encoded with Encode_func, the body and files have to be encoded as a whole,
+// and are kept in memory.
+//
+// Files created with NewMessageFileReader are streamed from their reader.
+// Their data is encoded with the file encoding in chunks of FILE_CHUNK_SIZE, or escaped when escaping is enabled.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var cw = &countWriter{w: w}
+	var err = m.writeTo(cw)
+	return cw.n, err
+}
+
+func (m *Message) writeTo(w io.Writer) error {
+	var header_delimiter = m.HeaderDelimiter()
+	// Everything before the trailer is included in the message checksum.
+	var message_hash hash.Hash
+	if m.MessageChecksum {
+		if message_hash = m.ChecksumAlgorithm.hash(); message_hash != nil {
+			w = io.MultiWriter(w, message_hash)
+		}
+	}
+	if m.Escape {
+		if err := validEscapeDelimiter(m.Delimiter); err != nil {
+			return err
+		}
+		// Write the escape marker as the first header.
+		if err := writeAll(w, []byte(ESCAPE_MARKER), m.Delimiter, []byte(ESCAPE_VERSION), header_delimiter); err != nil {
+			return err
+		}
+	}
+	if m.Codec != nil && !m.Headers.Has(CONTENT_TYPE_HEADER) {
+		m.Headers.Set(CONTENT_TYPE_HEADER, m.Codec.ContentType())
+	}
+	if err := m.writeHeaders(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(header_delimiter); err != nil {
+		return err
+	}
+	if m.Encode_func != nil && m.Decode_func != nil && m.UseEncoding {
+		// If encoding is set, create buffer and encode body
+		var bodybuffer bytes.Buffer
+		if err := m.writeBody(&bodybuffer); err != nil {
+			return err
+		}
+		if _, err := w.Write(m.Encode_func(bodybuffer.Bytes())); err != nil {
+			return err
+		}
+	} else if err := m.writeBody(w); err != nil {
+		return err
+	}
+	if message_hash != nil {
+		var trailer = escape([]byte(m.ChecksumAlgorithm.format(message_hash)), m.Delimiter)
+		if err := writeAll(w, m.TrailerDelimiter(), trailer); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(m.EndingDelimiter())
+	return err
+}
+
+// Write the headers of the message.
+func (m *Message) writeHeaders(w io.Writer) error {
+	var LenDelim = len(m.Delimiter)
+	var lenHDelim = LenDelim * 2
+	for key, value := range m.Headers {
+		if m.Escape {
+			key, value = m.escapeHeader(key, value)
+		}
+		// Create buffer for length of current header line;
+		// first get the total length
+		var total_len int = 0
+		for _, str := range value {
+			// Append key and value to headerline
+			total_len = total_len + len(str) + LenDelim
+		}
+		// Create headerline
+		var headerline []byte = make([]byte, len(key)+lenHDelim+total_len)
+		// Copy key to headerline
+		var n int = copy(headerline, key)
+		// Copy delimiter to headerline
+		n = n + copy(headerline[n:], m.Delimiter)
+		// Copy values to headerline
+		for _, str := range value {
+			n = n + copy(headerline[n:], str)
+			n = n + copy(headerline[n:], m.Delimiter)
+		}
+		copy(headerline[n:], m.Delimiter)
+		if _, err := w.Write(headerline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the files and the body of the message.
+func (m *Message) writeBody(w io.Writer) error {
+	for _, file := range m.Files {
+		if err := m.writeFile(w, file); err != nil {
+			return err
+		}
+	}
+	// Write a NULL byte if body is empty.
+	// This is to prevent one of the files ending up as the body, when no body is provided.
+	var body = m.Body
+	if len(body) == 0 {
+		body = []byte{0x00}
+	} else if m.Escape {
+		body = escape(body, m.Delimiter)
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// Write a single file.
+// Format: filename + metadata + HEADER_DELIMITER + encoding + HEADER_DELIMITER + data + FILE_DELIMITER
+func (m *Message) writeFile(w io.Writer, file *MessageFile) error {
+	var header_delimiter = m.HeaderDelimiter()
+	var file_delimiter = m.FileDelimiter()
+	encoding, encode, err := m.fileEncoder()
+	if err != nil {
+		return err
+	}
+	if file.open != nil {
+		return m.writeDiskFile(w, file, encoding, encode)
+	}
+	var fname = m.fileNameField(file)
+	if file.reader != nil {
+		// Escaped data never contains the delimiter, otherwise the data is always encoded,
+		// since it cannot be checked for delimiters before sending.
+		var is_encoded = !m.Escape
+		if err := writeAll(w, fname, header_delimiter, encodingFlag(encoding, is_encoded), header_delimiter); err != nil {
+			return err
+		}
+		var r = file.reader
+		if file.size >= 0 {
+			r = &sizedReader{r: r, n: file.size}
+		}
+		var cw = &countWriter{w: w}
+		if is_encoded {
+			err = encodeChunks(cw, r, encode)
+		} else {
+			_, err = io.Copy(&escapeWriter{w: cw, delimiter: m.Delimiter}, r)
+		}
+		if err != nil {
+			return err
+		}
+		return m.endFile(w, cw.n)
+	}
+	var fdata []byte
+	var should_be_encoded bool = bytes.Contains(file.Data, file_delimiter) || bytes.Contains(file.Data, header_delimiter) || isEmptyFileData(file.Data)
+	if len(file.Data) == 0 {
+		// Write a NULL byte if the file is empty, like the body.
+		should_be_encoded = false
+		fdata = []byte{0x00}
+	} else if m.Escape {
+		// Escaped data never contains the delimiter, no need to encode it.
+		should_be_encoded = false
+		fdata = escape(file.Data, m.Delimiter)
+	} else if should_be_encoded {
+		fdata = encode(file.Data)
+	} else {
+		fdata = file.Data
+	}
+	return writeAll(w, fname, header_delimiter, encodingFlag(encoding, should_be_encoded), header_delimiter, fdata, file_delimiter)
+}
+
+// Get the flag sent with a file, the name of its encoding, or "false" when it is not encoded.
+func encodingFlag(encoding string, is_encoded bool) []byte {
+	if !is_encoded {
+		return []byte("false")
+	}
+	return []byte(encoding)
+}
+
+// Write a file which is streamed from disk.
+// The file is read twice: once to check it for delimiters and compute its checksum,
+// and once to write it, so it is never loaded into memory as a whole.
+func (m *Message) writeDiskFile(w io.Writer, file *MessageFile, encoding string, encode func([]byte) []byte) error {
+	var header_delimiter = m.HeaderDelimiter()
+	f, err := file.open()
+	if err != nil {
+		return err
+	}
+	var scanner = &delimiterScanner{delimiter: header_delimiter}
+	var hash = m.ChecksumAlgorithm.hash()
+	if hash != nil {
+		_, err = io.Copy(io.MultiWriter(hash, scanner), f)
+	} else {
+		_, err = io.Copy(scanner, f)
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	file.Checksum = ""
+	if hash != nil {
+		file.Checksum = m.ChecksumAlgorithm.format(hash)
+	}
+	// The file delimiter contains the header delimiter, no need to check for both.
+	var should_be_encoded = (scanner.found || scanner.null && scanner.n == 1) && !m.Escape
+	if err := writeAll(w, m.fileNameField(file), header_delimiter, encodingFlag(encoding, should_be_encoded), header_delimiter); err != nil {
+		return err
+	}
+	if f, err = file.open(); err != nil {
+		return err
+	}
+	defer f.Close()
+	var cw = &countWriter{w: w}
+	if should_be_encoded {
+		err = encodeChunks(cw, f, encode)
+	} else if m.Escape {
+		_, err = io.Copy(&escapeWriter{w: cw, delimiter: m.Delimiter}, f)
+	} else {
+		_, err = io.Copy(cw, f)
+	}
+	if err != nil {
+		return err
+	}
+	return m.endFile(w, cw.n)
+}
+
+// End a streamed file, of which n bytes of data were written.
+// A NULL byte is written for empty files, so the file delimiter never directly follows the header delimiter.
+func (m *Message) endFile(w io.Writer, n int64) error {
+	if n == 0 {
+		if _, err := w.Write([]byte{0x00}); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(m.FileDelimiter())
+	return err
+}
+
+// Check if file data is a single NULL byte, which is sent for empty files.
+// Files which really hold a single NULL byte are encoded.
+func isEmptyFileData(data []byte) bool {
+	return len(data) == 1 && data[0] == 0x00
+}
+
+// Escape a header key and its values.
+func (m *Message) escapeHeader(key string, values []string) (string, []string) {
+	var escaped = make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = escapeHeaderString(value, m.Delimiter)
+	}
+	return escapeHeaderString(key, m.Delimiter), escaped
+}
+
+// Read all data from r, and write it to w encoded in chunks of FILE_CHUNK_SIZE.
+func encodeChunks(w io.Writer, r io.Reader, encode func([]byte) []byte) error {
+	var buf = make([]byte, FILE_CHUNK_SIZE)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := w.Write(encode(buf[:n])); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Write all byte slices to w.
+func writeAll(w io.Writer, data ...[]byte) error {
+	for _, b := range data {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sizedReader reads exactly n bytes from the underlying reader.
+// It returns an error if the reader ends early.
+type sizedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.r.Read(p)
+	s.n -= int64(n)
+	if err == io.EOF && s.n > 0 {
+		err = errors.New("file is shorter than its size")
+	}
+	return n, err
+}
+
+// delimiterScanner checks if the data written to it contains the delimiter.
+// The end of the previous write is kept, to find a delimiter split over two writes.
+// It also keeps the size of the data, and if it starts with a NULL byte.
+type delimiterScanner struct {
+	delimiter []byte
+	tail      []byte
+	found     bool
+	n         int64
+	null      bool
+}
+
+func (d *delimiterScanner) Write(p []byte) (int, error) {
+	if d.n == 0 && len(p) > 0 {
+		d.null = p[0] == 0x00
+	}
+	d.n += int64(len(p))
+	if d.found {
+		return len(p), nil
+	}
+	var overlap = len(d.delimiter) - 1
+	if len(d.tail) > 0 {
+		var head = p
+		if len(head) > overlap {
+			head = head[:overlap]
+		}
+		if bytes.Contains(append(d.tail, head...), d.delimiter) {
+			d.found = true
+			return len(p), nil
+		}
+	}
+	if bytes.Contains(p, d.delimiter) {
+		d.found = true
+		return len(p), nil
+	}
+	if len(p) >= overlap {
+		d.tail = append(d.tail[:0], p[len(p)-overlap:]...)
+	} else {
+		d.tail = append(d.tail, p...)
+		if len(d.tail) > overlap {
+			d.tail = d.tail[len(d.tail)-overlap:]
+		}
+	}
+	return len(p), nil
+}
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// escapeWriter escapes all data before writing it to the underlying writer.
+type escapeWriter struct {
+	w         io.Writer
+	delimiter []byte
+}
+
+func (e *escapeWriter) Write(p []byte) (int, error) {
+	if _, err := e.w.Write(escape(p, e.delimiter)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
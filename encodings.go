@@ -7,7 +7,9 @@ import (
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"io"
+	"sync"
 )
 
 // Base 64 encoding.
@@ -130,3 +132,91 @@ func GZIPdecompress(data []byte) ([]byte, error) {
 
 	return result, nil
 }
+
+// Name of the file encoding used by NewMessage.
+const DEFAULT_FILE_ENCODING = "base64"
+
+// A FileEncoding encodes the data of files which contain the delimiter.
+// Its name is sent with every encoded file, so the receiver can decode it.
+type FileEncoding struct {
+	Name   string
+	Encode func([]byte) []byte
+	Decode func([]byte) ([]byte, error)
+}
+
+var fileEncodings = struct {
+	sync.RWMutex
+	m map[string]*FileEncoding
+}{m: make(map[string]*FileEncoding)}
+
+func init() {
+	RegisterFileEncoding("base64", Base64Encoding, Base64Decoding)
+	RegisterFileEncoding("base32", Base32Encoding, Base32Decoding)
+	RegisterFileEncoding("hex", Base16Encoding, Base16Decoding)
+}
+
+// RegisterFileEncoding registers a file encoding under a name.
+// An encoding registered earlier under the same name is replaced.
+//
+// Names may only hold lowercase letters and digits, and cannot be "true" or "false".
+// The encoded data must not contain the delimiter.
+// Streamed files are encoded in chunks of FILE_CHUNK_SIZE bytes,
+// so the concatenated encoded chunks must decode to the concatenated data.
+func RegisterFileEncoding(name string, encode func([]byte) []byte, decode func([]byte) ([]byte, error)) {
+	if !validEncodingName(name) {
+		panic("invalid file encoding name: " + name)
+	}
+	fileEncodings.Lock()
+	defer fileEncodings.Unlock()
+	fileEncodings.m[name] = &FileEncoding{Name: name, Encode: encode, Decode: decode}
+}
+
+// GetFileEncoding returns the file encoding registered under a name.
+func GetFileEncoding(name string) (*FileEncoding, bool) {
+	fileEncodings.RLock()
+	defer fileEncodings.RUnlock()
+	enc, ok := fileEncodings.m[name]
+	return enc, ok
+}
+
+// Check if a name can be used for a file encoding.
+func validEncodingName(name string) bool {
+	if name == "" || name == "true" || name == "false" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if (name[i] < 'a' || name[i] > 'z') && (name[i] < '0' || name[i] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the flag which is sent with encoded files, and the function to encode them.
+// When no file encoding is set, F_Encoder is used, and the files are flagged with "true".
+func (m *Message) fileEncoder() (string, func([]byte) []byte, error) {
+	if m.FileEncoding == "" {
+		return "true", m.F_Encoder, nil
+	}
+	enc, ok := GetFileEncoding(m.FileEncoding)
+	if !ok {
+		return "", nil, errors.New("unknown file encoding " + m.FileEncoding)
+	}
+	return enc.Name, enc.Encode, nil
+}
+
+// Get the function to decode a file sent with the flag.
+// Files flagged with "true" are decoded with F_Decoder, files flagged with "false" are not encoded.
+func (m *Message) fileDecoder(flag string) (func([]byte) ([]byte, error), error) {
+	switch flag {
+	case "false":
+		return nil, nil
+	case "true":
+		return m.F_Decoder, nil
+	}
+	enc, ok := GetFileEncoding(flag)
+	if !ok {
+		return nil, errors.New("unknown file encoding " + flag)
+	}
+	return enc.Decode, nil
+}
@@ -0,0 +1,125 @@
+package quickproto
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Escaping replaces every byte of the delimiter, the escape byte itself and the NULL byte
+// with the escape byte, followed by two letters in the range A-P holding the high and low nibble.
+//
+// Example with the delimiter "$":
+//
+//	"a$b=c" -> "a=CEb=DNc"
+//
+// Escaped data never contains the delimiter, so headers, filenames, files and the body may hold any bytes.
+const ESCAPE_BYTE byte = '='
+
+// Escaped messages start with this header, the value is the escaping version.
+// The key can never be produced by escaping user data, since 'V' is not a valid nibble letter.
+const (
+	ESCAPE_MARKER  = "=V"
+	ESCAPE_VERSION = "1"
+)
+
+// Bytes which may not be used in a delimiter when escaping is enabled.
+const escapeReserved = "=ABCDEFGHIJKLMNOPV"
+
+// Check if the delimiter can be used with escaping.
+func validEscapeDelimiter(delimiter []byte) error {
+	if bytes.ContainsAny(delimiter, escapeReserved) {
+		return errors.New("delimiter cannot contain escape characters")
+	}
+	return nil
+}
+
+// Check if a byte must be escaped.
+func mustEscape(b byte, delimiter []byte) bool {
+	return b == ESCAPE_BYTE || b == 0x00 || bytes.IndexByte(delimiter, b) >= 0
+}
+
+// Escape data so it does not contain the delimiter.
+// The data is returned as is when nothing needs to be escaped.
+func escape(data []byte, delimiter []byte) []byte {
+	var count int
+	for _, b := range data {
+		if mustEscape(b, delimiter) {
+			count++
+		}
+	}
+	if count == 0 {
+		return data
+	}
+	var escaped = make([]byte, 0, len(data)+count*2)
+	for _, b := range data {
+		if mustEscape(b, delimiter) {
+			escaped = append(escaped, ESCAPE_BYTE, 'A'+(b>>4), 'A'+(b&0x0f))
+		} else {
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+// Escape a string so it does not contain the delimiter.
+func escapeString(s string, delimiter []byte) string {
+	return string(escape([]byte(s), delimiter))
+}
+
+// Empty header keys and values can not be told apart from the delimiters around them,
+// so they are sent as a single NULL byte when escaping. Escaped data never contains a NULL byte.
+const escapedEmpty = "\x00"
+
+// Escape a header key or value, see escapedEmpty.
+func escapeHeaderString(s string, delimiter []byte) string {
+	if s == "" {
+		return escapedEmpty
+	}
+	return escapeString(s, delimiter)
+}
+
+// Unescape a header key or value escaped with escapeHeaderString().
+func unescapeHeaderString(b []byte) (string, error) {
+	if string(b) == escapedEmpty {
+		return "", nil
+	}
+	return unescapeString(b)
+}
+
+// Check the escaping version of a message, the values of the escape marker header.
+func checkEscapeVersion(values []string) error {
+	if len(values) != 1 || values[0] != ESCAPE_VERSION {
+		return errors.New("unsupported escape version")
+	}
+	return nil
+}
+
+// Unescape data escaped with escape().
+// The data is returned as is when it does not contain any escape sequences.
+func unescape(data []byte) ([]byte, error) {
+	var i = bytes.IndexByte(data, ESCAPE_BYTE)
+	if i < 0 {
+		return data, nil
+	}
+	var unescaped = make([]byte, 0, len(data))
+	for i >= 0 {
+		unescaped = append(unescaped, data[:i]...)
+		if len(data) < i+3 {
+			return nil, errors.New("invalid escape sequence")
+		}
+		hi, lo := data[i+1]-'A', data[i+2]-'A'
+		if hi > 0x0f || lo > 0x0f {
+			return nil, errors.New("invalid escape sequence")
+		}
+		unescaped = append(unescaped, hi<<4|lo)
+		data = data[i+3:]
+		i = bytes.IndexByte(data, ESCAPE_BYTE)
+	}
+	return append(unescaped, data...), nil
+}
+
+// Unescape a string escaped with escapeString().
+func unescapeString(b []byte) (string, error) {
+	data, err := unescape(b)
+	return string(data), err
+}
@@ -0,0 +1,112 @@
+package quickproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+)
+
+// Framing decides how ReadConn and WriteConn find the boundaries of a message on the wire.
+type Framing int
+
+const (
+	// Every frame ends with the ending delimiter of the message.
+	// This is the default, and the only format quickproto.py understands.
+	FramingDelimiter Framing = iota
+	// Every frame starts with a fixed size header, holding flags and the length of the payload.
+	// The payload itself may contain any bytes, so encrypted and compressed data is framed safely.
+	FramingLength
+)
+
+// Length framing header layout:
+//
+//	[0]    magic byte 'Q'
+//	[1]    flags
+//	[2:10] payload length, big endian uint64
+const (
+	frameMagic      byte = 'Q'
+	frameHeaderSize int  = 10
+	// Payloads larger than this are read in steps, so the length sent by the peer is never allocated up front.
+	frameReadStep = 1 << 20
+)
+
+// Maximum size of a length framed payload, when Config.MaxFrameSize is 0.
+const DEFAULT_MAX_FRAME_SIZE = 64 * 1024 * 1024
+
+// Frame flags, telling the reader how the payload was transformed.
+const (
+	frameEncrypted  byte = 1 << 0
+	frameCompressed byte = 1 << 1
+)
+
+// String returns the name of the framing mode.
+func (f Framing) String() string {
+	switch f {
+	case FramingDelimiter:
+		return "delimiter"
+	case FramingLength:
+		return "length"
+	default:
+		return "unknown"
+	}
+}
+
+// Write a single length framed payload to the writer.
+func writeFrame(w io.Writer, flags byte, payload []byte) error {
+	var header [frameHeaderSize]byte
+	header[0] = frameMagic
+	header[1] = flags
+	binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	// net.Buffers uses writev when possible, so the payload is not copied.
+	var buffers = net.Buffers{header[:], payload}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+// Read the header of a length framed payload, returning its flags and the length of the payload.
+// Frames bigger than maxsize are rejected before allocating, 0 means DEFAULT_MAX_FRAME_SIZE,
+// and a negative size means no limit.
+func readFrameHeader(r io.Reader, maxsize int64) (byte, int64, error) {
+	if maxsize == 0 {
+		maxsize = DEFAULT_MAX_FRAME_SIZE
+	}
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, err
+	}
+	if header[0] != frameMagic {
+		return 0, 0, errors.New("invalid frame header")
+	}
+	var length = binary.BigEndian.Uint64(header[2:])
+	if (maxsize > 0 && length > uint64(maxsize)) || length > math.MaxInt {
+		return 0, 0, errors.New("frame exceeds maximum frame size")
+	}
+	return header[1], int64(length), nil
+}
+
+// Read the payload of a frame, of which the header was read with readFrameHeader.
+func readFramePayload(r io.Reader, length int64) ([]byte, error) {
+	if length <= frameReadStep {
+		var payload = make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return payload, nil
+	}
+	// Only grow the buffer as data arrives.
+	var payload bytes.Buffer
+	payload.Grow(frameReadStep)
+	if n, err := io.CopyN(&payload, r, length); err != nil {
+		if err == io.EOF && n < length {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package quickproto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header prefixes for cookies.
+// Cookies sent by the client, set by the server and deleted by the server.
+const (
+	COOKIES_PREFIX     = "q-cookies-"
+	SET_COOKIES_PREFIX = "q-set-cookies-"
+	DEL_COOKIES_PREFIX = "q-del-cookies-"
+)
+
+// Headers for matching responses to requests.
+// Messages get a random ID when they are written by a client or server,
+// responses carry the ID of their request as correlation ID.
+const (
+	MESSAGE_ID_HEADER     = "q-message-id"
+	CORRELATION_ID_HEADER = "q-correlation-id"
+)
+
+// Header of the notice a server sends before it closes the connection of a client.
+const CLOSE_HEADER = "q-close"
+
+// NewMessageID returns a new random message ID.
+func NewMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("quickproto: cannot generate message ID: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// ID returns the message ID, empty if the message has none.
+func (m *Message) ID() string {
+	return m.Headers.Get(MESSAGE_ID_HEADER)
+}
+
+// EnsureID gives the message a new message ID if it has none, and returns its ID.
+func (m *Message) EnsureID() string {
+	if id := m.ID(); id != "" {
+		return id
+	}
+	var id = NewMessageID()
+	m.Headers.Set(MESSAGE_ID_HEADER, id)
+	return id
+}
+
+// CorrelationID returns the ID of the request this message responds to, empty if it is not a response.
+func (m *Message) CorrelationID() string {
+	return m.Headers.Get(CORRELATION_ID_HEADER)
+}
+
+// ReplyTo marks the message as the response to a request.
+func (m *Message) ReplyTo(req *Message) {
+	m.Headers.Set(CORRELATION_ID_HEADER, req.ID())
+}
+
+// A Header holds the key/value pairs of a message.
+// Keys are case insensitive, they are stored in their canonical form.
+type Header map[string][]string
+
+// CanonicalHeaderKey returns the canonical form of a header key.
+// The canonical form is the key in lower case.
+func CanonicalHeaderKey(key string) string {
+	return strings.ToLower(key)
+}
+
+// Get the first value of a header.
+// Returns an empty string if the header is not set.
+func (h Header) Get(key string) string {
+	var values = h[CanonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Get all values of a header.
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// Set a header to a single value, replacing any existing values.
+func (h Header) Set(key string, value string) {
+	h[CanonicalHeaderKey(key)] = []string{value}
+}
+
+// Add a value to a header.
+func (h Header) Add(key string, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Delete a header.
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
+
+// Check if a header is set.
+func (h Header) Has(key string) bool {
+	_, ok := h[CanonicalHeaderKey(key)]
+	return ok
+}
+
+// Clone returns a copy of the header.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	var clone = make(Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// Get the first value of a header as an int.
+func (h Header) GetInt(key string) (int, error) {
+	value, err := h.value(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Get the first value of a header as a bool.
+func (h Header) GetBool(key string) (bool, error) {
+	value, err := h.value(key)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// Get the first value of a header as a duration.
+// The value is parsed with time.ParseDuration.
+func (h Header) GetDuration(key string) (time.Duration, error) {
+	value, err := h.value(key)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(value)
+}
+
+// Get the first value of a header as a time.
+// The value must be formatted as RFC3339.
+func (h Header) GetTime(key string) (time.Time, error) {
+	value, err := h.value(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Get the first value of a header, or an error if the header is not set.
+func (h Header) value(key string) (string, error) {
+	var values = h[CanonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return "", errors.New("header " + key + " not set")
+	}
+	return values[0], nil
+}
@@ -0,0 +1,459 @@
+package quickproto
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marshaler is implemented by types which can marshal themselves into a header value, the body or a file.
+type Marshaler interface {
+	MarshalQP() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types which can unmarshal a header value, the body or a file into themselves.
+type Unmarshaler interface {
+	UnmarshalQP([]byte) error
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	timeType        = reflect.TypeOf(time.Time{})
+	durationType    = reflect.TypeOf(time.Duration(0))
+	bytesType       = reflect.TypeOf([]byte(nil))
+)
+
+// Where a struct field is stored in the message.
+const (
+	fieldHeader = "header"
+	fieldBody   = "body"
+	fieldFile   = "file"
+)
+
+// Marshal a struct into a new message, with the standard delimiter.
+// Use MarshalMessage to marshal into a message created from a Config.
+//
+// Fields are mapped with the qp struct tag:
+//
+//	Name  string    `qp:"name"`              // header "name"
+//	Tags  []string  `qp:"tags,header"`       // header "tags", one value per item
+//	Data  []byte    `qp:"data,body"`         // the body
+//	Image []byte    `qp:"image.png,file"`    // file "image.png"
+//	Skip  string    `qp:"-"`                 // not marshalled
+//
+// Fields without a tag are stored in a header with the name of the field.
+// Fields of nested structs are stored in headers named "parent.child".
+// Body fields which are not a []byte, string or Marshaler are marshalled with the codec of the message.
+// Header values of time.Time are formatted as RFC3339, []byte is base64 encoded.
+func Marshal(v any) (*Message, error) {
+	var msg = NewMessage(nil, false, nil, nil)
+	if err := MarshalMessage(msg, v); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// MarshalMessage marshals a struct into an existing message.
+// See Marshal for how fields are mapped.
+func MarshalMessage(msg *Message, v any) error {
+	var rv = reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return errors.New("cannot marshal nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return errors.New("can only marshal structs")
+	}
+	return marshalStruct(msg, rv, "")
+}
+
+// Unmarshal a message into the struct v points to.
+// See Marshal for how fields are mapped.
+// Fields which are not in the message are left untouched.
+func Unmarshal(msg *Message, v any) error {
+	var rv = reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("can only unmarshal into a non-nil pointer")
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return errors.New("can only unmarshal into a pointer to a struct")
+	}
+	return unmarshalStruct(msg, rv, "")
+}
+
+// Get the name and kind of a struct field from its tag.
+// Returns an empty name if the field should be skipped.
+func fieldTag(field reflect.StructField) (string, string, error) {
+	if !field.IsExported() {
+		return "", "", nil
+	}
+	var tag = field.Tag.Get("qp")
+	if tag == "-" {
+		return "", "", nil
+	}
+	name, kind, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	switch kind {
+	case "":
+		kind = fieldHeader
+	case fieldHeader, fieldBody, fieldFile:
+	default:
+		return "", "", errors.New("invalid qp tag kind " + kind + " on field " + field.Name)
+	}
+	return name, kind, nil
+}
+
+// Check if a type is a struct whose fields should be marshalled as nested headers.
+func isNestedStruct(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return false
+	}
+	return !t.Implements(marshalerType) && !reflect.PointerTo(t).Implements(marshalerType)
+}
+
+func marshalStruct(msg *Message, rv reflect.Value, prefix string) error {
+	var rt = rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name, kind, err := fieldTag(rt.Field(i))
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		var fv = rv.Field(i)
+		if kind == fieldHeader && isNestedStruct(fv.Type()) {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if err := marshalStruct(msg, fv, prefix+name+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		switch kind {
+		case fieldHeader:
+			values, err := marshalValues(fv)
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				if err := msg.AddHeader(prefix+name, value); err != nil {
+					return err
+				}
+			}
+		case fieldBody:
+			if !isDataType(fv) {
+				// Other types are marshalled with the codec of the message.
+				if err := msg.SetBodyValue(fv.Interface()); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := marshalData(fv)
+			if err != nil {
+				return err
+			}
+			msg.Body = data
+		case fieldFile:
+			data, err := marshalData(fv)
+			if err != nil {
+				return err
+			}
+			msg.AddRawFile(prefix+name, data)
+		}
+	}
+	return nil
+}
+
+func unmarshalStruct(msg *Message, rv reflect.Value, prefix string) error {
+	var rt = rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name, kind, err := fieldTag(rt.Field(i))
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		var fv = rv.Field(i)
+		if kind == fieldHeader && isNestedStruct(fv.Type()) {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if err := unmarshalStruct(msg, fv, prefix+name+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		switch kind {
+		case fieldHeader:
+			var values = msg.Headers.Values(prefix + name)
+			if len(values) == 0 {
+				continue
+			}
+			if err := unmarshalValues(fv, values); err != nil {
+				return errors.New("cannot unmarshal header " + prefix + name + ": " + err.Error())
+			}
+		case fieldBody:
+			if !isDataType(fv) {
+				if err := msg.DecodeBody(fv.Addr().Interface()); err != nil {
+					return errors.New("cannot unmarshal body: " + err.Error())
+				}
+				continue
+			}
+			if err := unmarshalData(fv, msg.Body); err != nil {
+				return errors.New("cannot unmarshal body: " + err.Error())
+			}
+		case fieldFile:
+			var file = msg.Files[prefix+name]
+			if file == nil {
+				continue
+			}
+			data, err := file.readAll()
+			if err == nil {
+				err = unmarshalData(fv, data)
+			}
+			if err != nil {
+				return errors.New("cannot unmarshal file " + prefix + name + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Marshal a field into header values.
+// Slices, except for []byte, are marshalled into one value per item.
+func marshalValues(fv reflect.Value) ([]string, error) {
+	if fv.Kind() == reflect.Slice && fv.Type() != bytesType && !fv.Type().Implements(marshalerType) {
+		var values = make([]string, fv.Len())
+		for i := range values {
+			value, err := marshalValue(fv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+	if fv.Kind() == reflect.Pointer && fv.IsNil() {
+		return nil, nil
+	}
+	value, err := marshalValue(fv)
+	if err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
+}
+
+// Marshal a single value into a header value.
+func marshalValue(fv reflect.Value) (string, error) {
+	if m, ok := asMarshaler(fv); ok {
+		data, err := m.MarshalQP()
+		return string(data), err
+	}
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			return "", nil
+		}
+		fv = fv.Elem()
+	}
+	switch fv.Type() {
+	case timeType:
+		return fv.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	case durationType:
+		return time.Duration(fv.Int()).String(), nil
+	case bytesType:
+		return base64.StdEncoding.EncodeToString(fv.Bytes()), nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		return fv.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(fv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(fv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(fv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(fv.Float(), 'g', -1, fv.Type().Bits()), nil
+	}
+	return "", errors.New("cannot marshal type " + fv.Type().String() + " into a header")
+}
+
+// Unmarshal header values into a field.
+func unmarshalValues(fv reflect.Value, values []string) error {
+	if fv.Kind() == reflect.Slice && fv.Type() != bytesType && !reflect.PointerTo(fv.Type()).Implements(unmarshalerType) {
+		var slice = reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := unmarshalValue(slice.Index(i), value); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+	return unmarshalValue(fv, values[0])
+}
+
+// Unmarshal a single header value into a field.
+func unmarshalValue(fv reflect.Value, value string) error {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		if u, ok := fv.Interface().(Unmarshaler); ok {
+			return u.UnmarshalQP([]byte(value))
+		}
+		fv = fv.Elem()
+	}
+	if u, ok := asUnmarshaler(fv); ok {
+		return u.UnmarshalQP([]byte(value))
+	}
+	switch fv.Type() {
+	case timeType:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(t))
+		return nil
+	case durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	case bytesType:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		fv.SetBytes(b)
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	default:
+		return errors.New("cannot unmarshal a header into type " + fv.Type().String())
+	}
+	return nil
+}
+
+// Marshal a field into the body or a file.
+// Only []byte, string and types implementing Marshaler are supported.
+func marshalData(fv reflect.Value) ([]byte, error) {
+	if m, ok := asMarshaler(fv); ok {
+		return m.MarshalQP()
+	}
+	switch {
+	case fv.Type() == bytesType:
+		return fv.Bytes(), nil
+	case fv.Kind() == reflect.String:
+		return []byte(fv.String()), nil
+	}
+	return nil, errors.New("cannot marshal type " + fv.Type().String() + " into the body or a file")
+}
+
+// Unmarshal the body or a file into a field.
+func unmarshalData(fv reflect.Value, data []byte) error {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		if u, ok := fv.Interface().(Unmarshaler); ok {
+			return u.UnmarshalQP(data)
+		}
+		fv = fv.Elem()
+	}
+	if u, ok := asUnmarshaler(fv); ok {
+		return u.UnmarshalQP(data)
+	}
+	switch {
+	case fv.Type() == bytesType:
+		fv.SetBytes(data)
+	case fv.Kind() == reflect.String:
+		fv.SetString(string(data))
+	default:
+		return errors.New("cannot unmarshal the body or a file into type " + fv.Type().String())
+	}
+	return nil
+}
+
+// Check if a value can be stored in the body or a file as is,
+// or with its Marshaler.
+func isDataType(fv reflect.Value) bool {
+	var t = fv.Type()
+	if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+		return true
+	}
+	return t == bytesType || t.Kind() == reflect.String
+}
+
+// Get the Marshaler of a value, if it or its address implements it.
+func asMarshaler(fv reflect.Value) (Marshaler, bool) {
+	if fv.Kind() == reflect.Pointer && fv.IsNil() {
+		return nil, false
+	}
+	if m, ok := fv.Interface().(Marshaler); ok {
+		return m, true
+	}
+	if fv.CanAddr() {
+		m, ok := fv.Addr().Interface().(Marshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
+// Get the Unmarshaler of an addressable value.
+func asUnmarshaler(fv reflect.Value) (Unmarshaler, bool) {
+	if !fv.CanAddr() {
+		return nil, false
+	}
+	u, ok := fv.Addr().Interface().(Unmarshaler)
+	return u, ok
+}
@@ -0,0 +1,230 @@
+package quickproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS returns the files of the message as a read-only file system.
+// File names are used as slash separated paths, directories which are not in the message
+// themselves are created for every path. Names which are not valid paths, see fs.ValidPath, are left out.
+//
+// The file system is a snapshot of Files when FS is called.
+// It implements fs.ReadDirFS, fs.StatFS and fs.GlobFS.
+func (m *Message) FS() fs.FS {
+	var mfs = &messageFS{
+		files:    make(map[string]*MessageFile, len(m.Files)),
+		children: map[string][]string{".": nil},
+	}
+	for _, file := range m.Files {
+		var name = strings.TrimSuffix(file.Name, "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+		mfs.files[name] = file
+		mfs.addParents(name)
+		if file.IsDir() {
+			if _, ok := mfs.children[name]; !ok {
+				mfs.children[name] = nil
+			}
+		}
+	}
+	for _, children := range mfs.children {
+		sort.Strings(children)
+	}
+	return mfs
+}
+
+type messageFS struct {
+	// Files by path.
+	files map[string]*MessageFile
+	// Names of the entries in every directory, by path.
+	children map[string][]string
+}
+
+// Add a path to its parent directory, and all parents to theirs.
+func (mfs *messageFS) addParents(name string) {
+	for name != "." {
+		var dir = path.Dir(name)
+		children, ok := mfs.children[dir]
+		var base = path.Base(name)
+		for _, child := range children {
+			if child == base {
+				return
+			}
+		}
+		mfs.children[dir] = append(children, base)
+		if ok {
+			return
+		}
+		name = dir
+	}
+}
+
+// Check if a path is a directory.
+func (mfs *messageFS) isDir(name string) bool {
+	_, ok := mfs.children[name]
+	return ok
+}
+
+func (mfs *messageFS) Open(name string) (fs.File, error) {
+	info, err := mfs.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, _ := mfs.ReadDir(name)
+		return &messageDir{info: info, entries: entries}, nil
+	}
+	var file = mfs.files[name]
+	if file.open == nil && file.reader == nil {
+		// Keep in memory data seekable, for http.FileServer.
+		return &messageFSFile{info: info, r: bytes.NewReader(file.Data)}, nil
+	}
+	r, err := file.Open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &messageFSFile{info: info, r: r}, nil
+}
+
+func (mfs *messageFS) Stat(name string) (fs.FileInfo, error) {
+	return mfs.stat("stat", name)
+}
+
+func (mfs *messageFS) stat(op string, name string) (*fileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	var file, ok = mfs.files[name]
+	if mfs.isDir(name) {
+		var info = &fileInfo{name: path.Base(name), mode: fs.ModeDir | 0555}
+		if ok && file.IsDir() {
+			info.mode = file.Mode
+			info.modTime = file.ModTime
+		}
+		return info, nil
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	var mode = file.Mode
+	if mode == 0 {
+		mode = 0444
+	}
+	return &fileInfo{name: path.Base(name), size: int64(file.Size()), mode: mode, modTime: file.ModTime}, nil
+}
+
+func (mfs *messageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	children, ok := mfs.children[name]
+	if !ok {
+		if _, ok := mfs.files[name]; ok {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries = make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		info, err := mfs.stat("readdir", path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+func (mfs *messageFS) Glob(pattern string) ([]string, error) {
+	// Check the pattern, path.Match only reports errors when it gets to them.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches = make([]string, 0)
+	for name := range mfs.children {
+		if ok, _ := path.Match(pattern, name); ok && name != "." {
+			matches = append(matches, name)
+		}
+	}
+	for name := range mfs.files {
+		if ok, _ := path.Match(pattern, name); ok && !mfs.isDir(name) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// fileInfo describes a file or directory in the file system of a message.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() any           { return nil }
+
+// messageFSFile is an opened file in the file system of a message.
+type messageFSFile struct {
+	info *fileInfo
+	r    io.Reader
+}
+
+func (f *messageFSFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *messageFSFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *messageFSFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.r.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errors.New("file " + f.info.name + " is not seekable")
+}
+
+func (f *messageFSFile) Close() error {
+	if c, ok := f.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// messageDir is an opened directory in the file system of a message.
+type messageDir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *messageDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *messageDir) Close() error               { return nil }
+
+func (d *messageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *messageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	var entries = d.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
@@ -3,7 +3,7 @@ package quickproto
 import (
 	"bytes"
 	"errors"
-	"strconv"
+	"io"
 	"strings"
 )
 
@@ -33,14 +33,42 @@ var BANNED_DELIMITERS = []string{
 type Message struct {
 	Data        []byte
 	Delimiter   []byte
-	Headers     map[string][]string
+	Headers     Header
 	Body        []byte
-	Files       map[string]*messageFile
+	Files       map[string]*MessageFile
 	UseEncoding bool
 	Encode_func func([]byte) []byte
 	Decode_func func([]byte) ([]byte, error)
-	F_Encoder   func([]byte) []byte
-	F_Decoder   func([]byte) ([]byte, error)
+	// Name of the registered encoding for files which contain the delimiter, see RegisterFileEncoding.
+	// Defaults to DEFAULT_FILE_ENCODING. The name is sent with every encoded file.
+	FileEncoding string
+	// Used to encode files when FileEncoding is empty, these are sent with the flag "true".
+	F_Encoder func([]byte) []byte
+	// Used to decode files sent with the flag "true".
+	F_Decoder func([]byte) ([]byte, error)
+	// How the message is framed when written with WriteConn.
+	Framing Framing
+	// Escape the delimiter in headers, filenames, files and the body when generating.
+	// Escaped messages are always recognized when parsing.
+	Escape bool
+	// Copy the body and files when parsing, instead of slicing them from Data.
+	OwnedCopy bool
+	// Received files larger than SpillThreshold bytes are written to a temporary file in SpillDir,
+	// instead of kept in memory. 0 means files are never spilled.
+	// Temporary files are removed by Close, or moved by MessageFile.Save.
+	// Parse still holds the whole message in Data, spilling only bounds memory when reading with a Decoder or ReadConn.
+	SpillThreshold int64
+	// Directory for temporary files, os.TempDir() if empty.
+	SpillDir string
+	// Algorithm for the checksums of files, and the message checksum. Defaults to ChecksumCRC32.
+	// Received checksums are always verified.
+	ChecksumAlgorithm ChecksumAlgorithm
+	// Send a checksum of the whole message after the body, and require it when parsing.
+	// A received message checksum is always verified, also when this is not set.
+	MessageChecksum bool
+	// Codec of the body, used by SetBodyValue and DecodeBody.
+	// The content-type header is sent when generating, and the codec is picked from it when parsing.
+	Codec Codec
 }
 
 // NewMessage creates a new Message.
@@ -49,28 +77,35 @@ func NewMessage(delimiter []byte, useencoding bool, encode_func func([]byte) []b
 		delimiter = STANDARD_DELIM
 	}
 	return &Message{
-		Data:        []byte{},
-		Delimiter:   delimiter,
-		Headers:     make(map[string][]string),
-		Body:        []byte{},
-		Files:       make(map[string]*messageFile),
-		UseEncoding: useencoding,
-		Encode_func: encode_func,
-		Decode_func: decode_func,
-		F_Encoder:   Base64Encoding,
-		F_Decoder:   Base64Decoding,
+		Data:         []byte{},
+		Delimiter:    delimiter,
+		Headers:      make(Header),
+		Body:         []byte{},
+		Files:        make(map[string]*MessageFile),
+		UseEncoding:  useencoding,
+		Encode_func:  encode_func,
+		Decode_func:  decode_func,
+		FileEncoding: DEFAULT_FILE_ENCODING,
+		F_Encoder:    Base64Encoding,
+		F_Decoder:    Base64Decoding,
 	}
 }
 
 // Add a header to the message.
+// The key is stored in its canonical form, see CanonicalHeaderKey.
+// When escaping is enabled, the key and value may contain the delimiter, and may be empty.
 func (m *Message) AddHeader(key string, value string) error {
+	if m.Escape {
+		m.Headers.Add(key, value)
+		return nil
+	}
 	if strings.Contains(key, string(m.Delimiter)) {
 		return errors.New("header key cannot contain delimiter")
 	}
 	if strings.Contains(value, string(m.Delimiter)) {
 		return errors.New("header value cannot contain delimiter")
 	}
-	m.Headers[key] = append(m.Headers[key], value)
+	m.Headers.Add(key, value)
 	return nil
 }
 
@@ -82,7 +117,7 @@ func (m *Message) AddContent(content any) error {
 		m.Body = append(m.Body, content...)
 	case []byte:
 		m.Body = append(m.Body, content...)
-	case *messageFile:
+	case *MessageFile:
 		m.Files[content.Name] = content
 	default:
 		return errors.New("invalid content type")
@@ -91,18 +126,39 @@ func (m *Message) AddContent(content any) error {
 }
 
 // Add a MessageFile to the message.
-func (m *Message) AddFile(file *messageFile) {
+func (m *Message) AddFile(file *MessageFile) {
 	m.Files[file.Name] = file
 }
 
 // Create a MessageFile, and add it to the message.
 func (m *Message) AddRawFile(name string, data []byte) {
-	m.Files[name] = &messageFile{Name: name, Data: data}
+	m.Files[name] = NewMessageFile(name, data)
+}
+
+// Add a file on disk to the message.
+// The file is streamed from disk when the message is written, see NewMessageFileFromPath.
+func (m *Message) AddFileFromPath(path string) error {
+	file, err := NewMessageFileFromPath(path)
+	if err != nil {
+		return err
+	}
+	m.AddFile(file)
+	return nil
+}
+
+// Add a file of which the data is read from r when the message is written.
+// Exactly size bytes are read from r, pass -1 if the size is unknown.
+// The reader is only read once, so the message can only be written once.
+func (m *Message) AddFileReader(name string, r io.Reader, size int64) {
+	file := NewMessageFileReader(name, r)
+	file.size = size
+	m.AddFile(file)
 }
 
 // Header delimiter, returns DELIMITER + DELIMITER
 func (m *Message) HeaderDelimiter() []byte {
-	return append(m.Delimiter, m.Delimiter...)
+	// Never append to the spare capacity of Delimiter, which is shared by all delimiters.
+	return append(m.Delimiter[:len(m.Delimiter):len(m.Delimiter)], m.Delimiter...)
 }
 
 // Body delimiter, returns HEADER_DELIMITER + HEADER_DELIMITER
@@ -115,6 +171,11 @@ func (m *Message) FileDelimiter() []byte {
 	return append(m.BodyDelimiter(), m.HeaderDelimiter()...)
 }
 
+// Trailer delimiter, returns FILE_DELIMITER + TRAILER_MARKER + DELIMITER
+func (m *Message) TrailerDelimiter() []byte {
+	return append(append(m.FileDelimiter(), TRAILER_MARKER...), m.Delimiter...)
+}
+
 // End delimiter, returns BODY_DELIMITER + BODY_DELIMITER
 func (m *Message) EndingDelimiter() []byte {
 	return append(m.BodyDelimiter(), m.BodyDelimiter()...)
@@ -123,176 +184,247 @@ func (m *Message) EndingDelimiter() []byte {
 // parses protocol messages.
 // Header is a map of key/value pairs.
 // Body is a base64 encoded byte slice.
+//
+// The data is scanned once, from start to end.
+// Header keys and values share a single string, the body and files are slices of m.Data,
+// unless the body had to be decoded or unescaped, or m.OwnedCopy is set.
 func (m *Message) Parse() (*Message, error) {
 	///////////////////////////////////////////////
-	// Splitting order
-	// 1. Split body and head
-	//	    a. Split head into key/value pairs
-	//	    b. Split key/value pairs into key and values
-	// 2. Split files from body
-	//	    a. Split files into file name and data
+	// Scanning order
+	// 1. Scan header lines until an empty line
+	//	    a. Split lines into key and values
+	// 2. Decode the body, if needed
+	// 3. Scan files until no file delimiter is left
+	//	    a. Split files into file name, is_encoded and data
+	// 4. The remainder is the body
 	///////////////////////////////////////////////
-	header_delimiter := m.HeaderDelimiter()
-	file_delimiter := m.FileDelimiter()
-	body_delimiter := m.BodyDelimiter()
-	ending_delimiter := m.EndingDelimiter()
-	// Split data into headers and body
-	datalist := bytes.SplitN(m.Data, body_delimiter, 2)
-	if len(datalist) != 2 {
-		return nil, errors.New("invalid message sent")
-	}
-	// Split headers into key/value pairs
-	headers := bytes.Split(datalist[0], header_delimiter)
-	for _, header := range headers {
-		head := bytes.Split(header, m.Delimiter)
-		if len(head) < 2 {
+	var (
+		data             = m.Data
+		lenDelim         = len(m.Delimiter)
+		delimiters       = bytes.Repeat(m.Delimiter, 8)
+		header_delimiter = delimiters[:lenDelim*2]
+		file_delimiter   = delimiters[:lenDelim*6]
+		ending_delimiter = delimiters
+	)
+	// Escaped messages start with the escape marker header.
+	escaped := len(data) > len(ESCAPE_MARKER) && string(data[:len(ESCAPE_MARKER)]) == ESCAPE_MARKER &&
+		bytes.HasPrefix(data[len(ESCAPE_MARKER):], m.Delimiter)
+	// Scan header lines, remember where keys and values are.
+	var spanbuf [64]span
+	var linebuf [16]headerLine
+	var spans = spanbuf[:0]
+	var lines = linebuf[:0]
+	var pos int
+	for !bytes.HasPrefix(data[pos:], header_delimiter) {
+		var end = bytes.Index(data[pos:], header_delimiter)
+		if end < 0 {
+			return nil, errors.New("invalid message sent")
+		}
+		end = pos + end
+		var line = headerLine{key: span{pos, end}, values: len(spans)}
+		if i := bytes.Index(data[pos:end], m.Delimiter); i >= 0 {
+			line.key.end = pos + i
+		}
+		if line.key.end == end {
 			return nil, errors.New("invalid header key value sent")
 		}
-		str_list := make([]string, 0)
-		// Set multiple values for each key
-		for _, byt := range head[1:] {
-			str_list = append(str_list, string(byt))
+		for start := line.key.end + lenDelim; ; {
+			var i = bytes.Index(data[start:end], m.Delimiter)
+			if i < 0 {
+				spans = append(spans, span{start, end})
+				break
+			}
+			spans = append(spans, span{start, start + i})
+			start = start + i + lenDelim
+		}
+		line.count = len(spans) - line.values
+		lines = append(lines, line)
+		pos = end + len(header_delimiter)
+	}
+	// All keys and values are substrings of a single string.
+	var headers = string(data[:pos])
+	var values = make([]string, len(spans))
+	for _, line := range lines {
+		if escaped && headers[line.key.start:line.key.end] == ESCAPE_MARKER {
+			var version = make([]string, line.count)
+			for i, sp := range spans[line.values : line.values+line.count] {
+				version[i] = headers[sp.start:sp.end]
+			}
+			if err := checkEscapeVersion(version); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		key, err := headerString(headers, line.key, escaped)
+		if err != nil {
+			return nil, err
+		}
+		var str_list = values[line.values : line.values+line.count : line.values+line.count]
+		for i, sp := range spans[line.values : line.values+line.count] {
+			if str_list[i], err = headerString(headers, sp, escaped); err != nil {
+				return nil, err
+			}
 		}
-		// Set key and values, lock for thread safety
-		m.Headers[string(head[0])] = str_list
+		m.Headers[CanonicalHeaderKey(key)] = str_list
 	}
-	// Decode base64 encoded body
-	var body []byte
+	m.detectCodec()
+	pos = pos + len(header_delimiter)
+	if pos > len(data) {
+		return nil, errors.New("invalid message sent")
+	}
+	// Decode the body and files
 	var err error
-	full_body := bytes.Trim(datalist[1], string(ending_delimiter))
+	var full_body = bytes.TrimSuffix(data[pos:], ending_delimiter)
+	// Verify and remove the message checksum trailer.
+	if body, checksum, ok, err := m.splitTrailer(full_body); err != nil {
+		return nil, err
+	} else if ok {
+		if err := verifyChecksum("", checksum, data[:pos+len(body)]); err != nil {
+			return nil, err
+		}
+		full_body = body
+	} else if m.MessageChecksum {
+		return nil, errors.New("message checksum missing")
+	}
 	if m.Encode_func != nil && m.Decode_func != nil && m.UseEncoding {
 		full_body, err = m.Decode_func(full_body)
 		if err != nil {
 			return nil, err
 		}
+	} else if m.OwnedCopy {
+		full_body = append([]byte(nil), full_body...)
 	}
-	body_data := bytes.Split(full_body, file_delimiter)
-	// Extract body from body_data
-	body = body_data[len(body_data)-1]
-	// Remove body from body_data
-	body_data = body_data[:len(body_data)-1]
-
-	// Extract files from body_data
-	for _, file := range body_data {
-		file_data_list := bytes.SplitN(file, header_delimiter, 3)
-		if len(file_data_list) != 3 {
-			return nil, errors.New("invalid file sent")
+	// Scan files, the remainder is the body.
+	pos = 0
+	for {
+		var end = bytes.Index(full_body[pos:], file_delimiter)
+		if end < 0 {
+			break
 		}
-		file_name := string(file_data_list[0])
-		is_encoded, err := strconv.ParseBool(string(file_data_list[1]))
+		end = pos + end
+		file, err := m.parseFile(full_body[pos:end], header_delimiter, escaped)
 		if err != nil {
-			return nil, errors.New("cannot parse file is_encoded")
+			// Remove files which were already spilled to disk.
+			m.Close()
+			return nil, err
 		}
-		var file_data []byte
-		if is_encoded {
-			file_data, err = m.F_Decoder(file_data_list[2])
-			if err != nil {
+		if old, ok := m.Files[file.Name]; ok {
+			// A file with the same name replaces the earlier one.
+			old.removeTemp()
+		}
+		m.Files[file.Name] = file
+		pos = end + len(file_delimiter)
+	}
+	var body = full_body[pos:]
+	// A single NULL byte is sent when the body is empty.
+	if len(body) != 1 || body[0] != 0x00 {
+		if escaped {
+			if body, err = unescape(body); err != nil {
+				m.Close()
 				return nil, err
 			}
-		} else {
-			file_data = file_data_list[2]
 		}
-		mf := NewmessageFile(file_name, file_data)
-		m.Files[file_name] = &mf
-	}
-	if len(body) != 1 && body[0] != 0x00 {
 		m.Body = body
 	}
 	// m.Parsed = true
 	return m, nil
 }
 
-// creates a protocol message.
-// Header is a map of key/value pairs.
-// Body is a base64 encoded byte slice.
-func (m *Message) Generate() (*Message, error) {
-	var buffer bytes.Buffer
-	// Predefine delimiters so we dont have to calculate them every time.
+// Parse a single file.
+// Format: filename + metadata + HEADER_DELIMITER + encoding + HEADER_DELIMITER + data
+//
+// The encoding is the name of a file encoding, or "false" for files which are not encoded.
+// Older versions send "true" for encoded files, these are decoded with F_Decoder.
+func (m *Message) parseFile(file []byte, header_delimiter []byte, escaped bool) (*MessageFile, error) {
+	var i = bytes.Index(file, header_delimiter)
+	if i < 0 {
+		return nil, errors.New("invalid file sent")
+	}
+	var j = bytes.Index(file[i+len(header_delimiter):], header_delimiter)
+	if j < 0 {
+		return nil, errors.New("invalid file sent")
+	}
 	var (
-		header_delimiter = m.HeaderDelimiter()
-		file_delimiter   = m.FileDelimiter()
-		LenDelim         = len(m.Delimiter)
-		lenHDelim        = LenDelim * 2
-		lenFDelim        = lenHDelim * 3
-		lenBDelim        = lenHDelim * 2
+		flag      = file[i+len(header_delimiter) : i+len(header_delimiter)+j]
+		file_data = file[i+len(header_delimiter)+j+len(header_delimiter):]
 	)
-	// Create headers
-	for key, value := range m.Headers {
-		// Create buffer for length of current header line;
-		// first get the total length
-		var total_len int = 0
-		for _, str := range value {
-			// Append key and value to headerline
-			total_len = total_len + len(str) + LenDelim
+	mf, err := parseFileNameField(file[:i], m.Delimiter, escaped)
+	if err != nil {
+		return nil, err
+	}
+	decode, err := m.fileDecoder(string(flag))
+	if err != nil {
+		return nil, err
+	}
+	if isEmptyFileData(file_data) {
+		// A single NULL byte is sent when the file is empty.
+		file_data = file_data[:0]
+	} else if decode != nil {
+		if file_data, err = decode(file_data); err != nil {
+			return nil, err
 		}
-		// Create headerline
-		var headerline []byte = make([]byte, len(key)+lenHDelim+total_len)
-		// Copy key to headerline
-		var n int = copy(headerline, key)
-		// Copy delimiter to headerline
-		n = n + copy(headerline[n:], m.Delimiter)
-		// Copy values to headerline
-		for _, str := range value {
-			n = n + copy(headerline[n:], str)
-			n = n + copy(headerline[n:], m.Delimiter)
+	} else if escaped {
+		if file_data, err = unescape(file_data); err != nil {
+			return nil, err
 		}
-		copy(headerline[n:], m.Delimiter)
-		// Copy headerline to buffer
-		buffer.Write(headerline)
 	}
-	// Get files
-	var bodybuffer bytes.Buffer
-	for _, file := range m.Files {
-		// Write the file to the body
-		// Create buffer for length of current file line
-		// Encode file data
-		var fdata []byte
-		var should_be_encoded bool = bytes.Contains(file.Data, file_delimiter) || bytes.Contains(file.Data, header_delimiter)
-		if should_be_encoded {
-			fdata = m.F_Encoder(file.Data)
-		} else {
-			fdata = file.Data
+	if mf.Checksum != "" {
+		if err := verifyChecksum(mf.Name, mf.Checksum, file_data); err != nil {
+			return nil, err
 		}
-		// Get size of buffer for all file data and delimiters
-		is_encoded := strconv.FormatBool(should_be_encoded)
-		var fileline []byte = make([]byte, len(file.Name)+lenBDelim+len(is_encoded)+len(fdata)+lenFDelim)
-		// Copy data to fileline
-		var n int = copy(fileline, file.Name)
-		n = n + copy(fileline[n:], header_delimiter)
-		n = n + copy(fileline[n:], is_encoded)
-		n = n + copy(fileline[n:], header_delimiter)
-		n = n + copy(fileline[n:], fdata)
-		copy(fileline[n:], file_delimiter)
-		// Append fileline to buffer
-		bodybuffer.Write(fileline)
 	}
-	// Append body to buffer
-	// Write a NULL byte if body is empty.
-	// This is to prevent one of the files ending up as the body, when no body is provided.
-	if len(m.Body) == 0 {
-		bodybuffer.Write([]byte{0x00})
-	} else {
-		bodybuffer.Write(m.Body)
+	if m.SpillThreshold > 0 && int64(len(file_data)) > m.SpillThreshold {
+		return mf, mf.readData(bytes.NewReader(file_data), m.SpillThreshold, m.SpillDir)
 	}
-	if m.Encode_func != nil && m.Decode_func != nil && m.UseEncoding {
-		// If encoding is set, create buffer and encode body
-		w_data := bodybuffer.Bytes()
-		enc_data := m.Encode_func(w_data)
-		buffer.Grow(len(enc_data) + len(m.EndingDelimiter()) + len(header_delimiter))
-		buffer.Write(header_delimiter)
-		buffer.Write(enc_data)
-	} else {
-		// Else write body to buffer
-		buffer.Grow(bodybuffer.Len() + len(m.EndingDelimiter()) + len(header_delimiter))
-		buffer.Write(header_delimiter)
-		buffer.Write(bodybuffer.Bytes())
+	mf.Data = file_data
+	return mf, nil
+}
+
+// Position of a header key or value in the data of a message.
+type span struct {
+	start, end int
+}
+
+// A header line, with the position of the key, and the range of its values in the list of spans.
+type headerLine struct {
+	key    span
+	values int
+	count  int
+}
+
+// Get a header key or value from the header string, unescaping it if needed.
+func headerString(headers string, sp span, escaped bool) (string, error) {
+	var s = headers[sp.start:sp.end]
+	if !escaped || (s != escapedEmpty && strings.IndexByte(s, ESCAPE_BYTE) < 0) {
+		return s, nil
+	}
+	return unescapeHeaderString([]byte(s))
+}
+
+// creates a protocol message.
+// Header is a map of key/value pairs.
+// Body is a base64 encoded byte slice.
+func (m *Message) Generate() (*Message, error) {
+	var buffer bytes.Buffer
+	if _, err := m.WriteTo(&buffer); err != nil {
+		return nil, err
 	}
-	buffer.Write(m.EndingDelimiter())
 	m.Data = buffer.Bytes()
 	// m.Generated = true
 	return m, nil
 }
 
+// Close removes the temporary files of files which were spilled to disk.
+func (m *Message) Close() error {
+	var err error
+	for _, file := range m.Files {
+		if e := file.removeTemp(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 // Get content length of the message.
 func (m *Message) ContentLength() int {
 	return len(m.Data)
@@ -1,37 +1,348 @@
 package quickproto
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// MIME type of files of which the type cannot be detected.
+const DEFAULT_MIME_TYPE = "application/octet-stream"
+
+// Sent in place of the checksum of files read from an io.Reader,
+// since their checksum is not known before they are sent.
+const NO_CHECKSUM = "none"
+
 // Message file used for storing files sent inside the Message struct
-type messageFile struct {
+type MessageFile struct {
 	Name string
 	Data []byte
+	// MIME type of the file, detected from the name or data if not provided.
+	MimeType string
+	// Permissions of the file, used by Save.
+	Mode os.FileMode
+	// Modification time of the file, used by Save.
+	ModTime time.Time
+	// Checksum of the received data, formatted as "<algorithm>:<hex>", see ChecksumAlgorithm.
+	// Computed from Data when the message is written, and verified when it is parsed.
+	Checksum string
+	// Path of the file on disk, for files created with NewMessageFileFromPath,
+	// and received files which were spilled to a temporary file.
+	Path string
+	// When set, the file data is streamed from the reader by Message.WriteTo instead of Data.
+	reader io.Reader
+	// When set, the file data is streamed from the opened file by Message.WriteTo instead of Data.
+	open func() (io.ReadCloser, error)
+	// Size of the data of streamed files, -1 if unknown.
+	size int64
+	// Is the file at Path a temporary file, which is removed by Message.Close?
+	temp bool
+}
+
+// NewMessageFile creates a new MessageFile.
+// The MIME type is detected from the name, or from the data if the name has no known extension.
+func NewMessageFile(name string, data []byte) *MessageFile {
+	return &MessageFile{
+		Name:     name,
+		Data:     data,
+		MimeType: detectMimeType(name, data),
+	}
 }
 
-// NewmessageFile creates a new messageFile.
-func NewmessageFile(name string, data []byte) messageFile {
-	// Get file mime type
-	return messageFile{
-		Name: name,
-		Data: data,
+// NewMessageFileReader creates a new MessageFile, of which the data is read from r when the message is written.
+// The reader is only read once.
+// The MIME type is detected from the name.
+func NewMessageFileReader(name string, r io.Reader) *MessageFile {
+	return &MessageFile{
+		Name:     name,
+		MimeType: detectMimeType(name, nil),
+		reader:   r,
+		size:     -1,
 	}
 }
 
+// NewMessageFileFromPath creates a new MessageFile for a file on disk.
+// The file is opened when the message is written, its data is never loaded into memory as a whole.
+// The mode and modification time are taken from the file.
+func NewMessageFileFromPath(path string) (*MessageFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New(path + " is not a regular file")
+	}
+	var mime_type = mime.TypeByExtension(filepath.Ext(path))
+	if mime_type == "" {
+		// Detect the type from the start of the file.
+		if mime_type, err = sniffMimeType(path); err != nil {
+			return nil, err
+		}
+	}
+	return &MessageFile{
+		Name:     filepath.Base(path),
+		MimeType: mime_type,
+		Mode:     info.Mode(),
+		ModTime:  info.ModTime(),
+		Path:     path,
+		open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+		size: info.Size(),
+	}, nil
+}
+
+// NewmessageFile creates a new MessageFile.
+//
+// Deprecated: use NewMessageFile.
+func NewmessageFile(name string, data []byte) MessageFile {
+	return *NewMessageFile(name, data)
+}
+
+// NewmessageFileReader creates a new MessageFile, of which the data is read from r when the message is written.
+//
+// Deprecated: use NewMessageFileReader.
+func NewmessageFileReader(name string, r io.Reader) MessageFile {
+	return *NewMessageFileReader(name, r)
+}
+
 // Size returns the size of the file.
-func (f *messageFile) Size() int {
+// For streamed files, this is the size of the data which will be sent, if known.
+func (f *MessageFile) Size() int {
+	if f.Data == nil && f.size > 0 {
+		return int(f.size)
+	}
 	return len(f.Data)
 }
 
+// IsDir reports whether the file is a directory entry, added by AddDir or AddFS.
+func (f *MessageFile) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+// Check if the data of the file is streamed, instead of taken from Data.
+func (f *MessageFile) streamed() bool {
+	return f.reader != nil || f.open != nil
+}
+
 // String returns the name of the file.
-func (f *messageFile) String() string {
+func (f *MessageFile) String() string {
 	return "[" + f.Name + ": " + strconv.Itoa(f.Size()) + " bytes]"
 }
 
-// Save the file to a path.
-func (f *messageFile) Save(path string) error {
-	return os.WriteFile(filepath.Join(path, f.Name), f.Data, 0644)
+// Open the data of the file for reading.
+// Files on disk are opened from their path, other files are read from Data.
+func (f *MessageFile) Open() (io.ReadCloser, error) {
+	if f.open != nil {
+		return f.open()
+	}
+	if f.reader != nil {
+		return nil, errors.New("file " + f.Name + " can only be read when the message is written")
+	}
+	return io.NopCloser(bytes.NewReader(f.Data)), nil
+}
+
+// Read all data of the file, from disk if the file was spilled or added from a path.
+func (f *MessageFile) readAll() ([]byte, error) {
+	if f.open == nil && f.reader == nil {
+		return f.Data, nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Set the path of the file, which is opened when the file is read.
+// The file at the path is no longer temporary.
+func (f *MessageFile) setPath(path string) {
+	f.Path = path
+	f.temp = false
+	f.open = func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// Remove the file if it is a temporary file.
+func (f *MessageFile) removeTemp() error {
+	if !f.temp {
+		return nil
+	}
+	f.temp = false
+	return os.Remove(f.Path)
+}
+
+// Read the data of a received file.
+// When more than threshold bytes are read, the data is spilled to a temporary file in dir,
+// and Data is left empty. A threshold of 0 keeps all data in memory.
+func (f *MessageFile) readData(r io.Reader, threshold int64, dir string) error {
+	if threshold <= 0 {
+		data, err := io.ReadAll(r)
+		f.Data = data
+		return err
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, threshold+1)
+	if err == io.EOF || (err == nil && n <= threshold) {
+		f.Data = buf.Bytes()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "quickproto-*")
+	if err != nil {
+		return err
+	}
+	// Remove the temporary file if anything goes wrong.
+	var size int64
+	if size, err = io.Copy(tmp, io.MultiReader(&buf, r)); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	f.Data = nil
+	f.size = size
+	f.setPath(tmp.Name())
+	f.temp = true
+	return nil
+}
+
+// Detect the MIME type of a file from its name, or from its data.
+func detectMimeType(name string, data []byte) string {
+	if mime_type := mime.TypeByExtension(filepath.Ext(name)); mime_type != "" {
+		return mime_type
+	}
+	if data != nil {
+		return http.DetectContentType(data)
+	}
+	return DEFAULT_MIME_TYPE
+}
+
+// Detect the MIME type of a file on disk from its first 512 bytes.
+func sniffMimeType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var buf = make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// Generate the name field of a file.
+// Format: filename + DELIMITER + mime type + DELIMITER + mode + DELIMITER + modification time + DELIMITER + checksum
+//
+// The metadata is always escaped, and never empty, so it can be split from the name from the right.
+func (m *Message) fileNameField(file *MessageFile) []byte {
+	var (
+		name      = file.Name
+		mime_type = file.MimeType
+		mtime     = "0"
+		checksum  = NO_CHECKSUM
+	)
+	if m.Escape {
+		name = escapeString(name, m.Delimiter)
+	}
+	if mime_type == "" {
+		mime_type = detectMimeType(file.Name, file.Data)
+	}
+	if !file.ModTime.IsZero() {
+		mtime = strconv.FormatInt(file.ModTime.UnixNano(), 10)
+	}
+	if !file.streamed() {
+		checksum = m.ChecksumAlgorithm.sum(file.Data)
+	} else if file.Checksum != "" {
+		checksum = file.Checksum
+	}
+	var field = make([]byte, 0, len(name)+len(mime_type)+len(checksum)+32+len(m.Delimiter)*4)
+	field = append(field, name...)
+	for _, meta := range []string{mime_type, strconv.FormatUint(uint64(file.Mode), 8), mtime, checksum} {
+		field = append(field, m.Delimiter...)
+		field = append(field, escape([]byte(meta), m.Delimiter)...)
+	}
+	return field
+}
+
+// Parse the name field of a file into a MessageFile without data.
+// Files sent without metadata only have a name.
+func parseFileNameField(field []byte, delimiter []byte, escaped bool) (*MessageFile, error) {
+	var file = &MessageFile{}
+	var meta [4]string
+	var name = field
+	var ok = true
+	for i := len(meta) - 1; i >= 0 && ok; i-- {
+		var j = bytes.LastIndex(name, delimiter)
+		if j < 0 {
+			ok = false
+			break
+		}
+		value, err := unescapeString(name[j+len(delimiter):])
+		if err != nil || value == "" {
+			ok = false
+			break
+		}
+		meta[i] = value
+		name = name[:j]
+	}
+	var err error
+	if ok {
+		ok = file.parseMetadata(meta) == nil
+	}
+	if !ok {
+		// No metadata, the whole field is the name.
+		file = &MessageFile{}
+		name = field
+	}
+	if escaped {
+		if file.Name, err = unescapeString(name); err != nil {
+			return nil, err
+		}
+	} else {
+		file.Name = string(name)
+	}
+	if file.MimeType == "" {
+		file.MimeType = detectMimeType(file.Name, nil)
+	}
+	return file, nil
+}
+
+// Set the metadata of a file, as sent in its name field.
+func (f *MessageFile) parseMetadata(meta [4]string) error {
+	mode, err := strconv.ParseUint(meta[1], 8, 32)
+	if err != nil {
+		return err
+	}
+	mtime, err := strconv.ParseInt(meta[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	if meta[3] != NO_CHECKSUM {
+		if _, _, ok := strings.Cut(meta[3], ":"); !ok {
+			return errors.New("invalid checksum")
+		}
+		f.Checksum = meta[3]
+	}
+	f.MimeType = meta[0]
+	f.Mode = os.FileMode(mode)
+	if mtime != 0 {
+		f.ModTime = time.Unix(0, mtime)
+	}
+	return nil
 }
@@ -0,0 +1,313 @@
+package quickproto
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// What to do when a file which is saved already exists.
+type OverwritePolicy int
+
+const (
+	// Replace existing files.
+	OverwriteAllow OverwritePolicy = iota
+	// Return an error when the file exists.
+	OverwriteDeny
+	// Leave the existing file, and do not save the file.
+	OverwriteSkip
+)
+
+// Options for MessageFile.SaveWithOptions.
+type SaveOptions struct {
+	// What to do when the file already exists.
+	Overwrite OverwritePolicy
+	// Allowed file extensions, like ".txt" or "png". Any extension is allowed if empty.
+	AllowedExtensions []string
+	// Maximum size of the file in bytes, 0 means no limit.
+	MaxSize int64
+	// Write the file to a temporary file in the same directory first, and rename it when done,
+	// so a partially written file is never visible.
+	Atomic bool
+}
+
+// Save the file to a directory.
+// The name of the file may contain subdirectories, but never leaves the directory,
+// see SaveWithOptions. Existing files are replaced.
+func (f *MessageFile) Save(path string) error {
+	return f.SaveWithOptions(path, nil)
+}
+
+// SaveWithOptions saves the file to a directory.
+// The name of the file is sent by the peer, so it is checked before saving:
+// absolute names, ".." segments and symlinks pointing outside of the directory are rejected.
+//
+// The mode and modification time of the file are applied, if set.
+// Temporary files are moved to the path instead of copied.
+func (f *MessageFile) SaveWithOptions(dir string, opts *SaveOptions) error {
+	if opts == nil {
+		opts = &SaveOptions{}
+	}
+	file_path, err := safeFilePath(dir, f.Name)
+	if err != nil {
+		return err
+	}
+	if f.IsDir() {
+		return f.saveDir(file_path)
+	}
+	if err := opts.check(f); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(file_path); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("file " + f.Name + " is a symlink")
+		}
+		switch opts.Overwrite {
+		case OverwriteDeny:
+			return errors.New("file " + f.Name + " already exists")
+		case OverwriteSkip:
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file_path), 0755); err != nil {
+		return err
+	}
+	var perm os.FileMode = 0644
+	if f.Mode.Perm() != 0 {
+		perm = f.Mode.Perm()
+	}
+	if opts.Atomic {
+		err = f.writeAtomic(file_path, perm)
+	} else {
+		err = f.write(file_path, perm, opts.Overwrite == OverwriteDeny)
+	}
+	if err != nil {
+		return err
+	}
+	// Existing files keep their permissions when written to.
+	if err := os.Chmod(file_path, perm); err != nil {
+		return err
+	}
+	if !f.ModTime.IsZero() {
+		return os.Chtimes(file_path, f.ModTime, f.ModTime)
+	}
+	return nil
+}
+
+// Create a directory entry, and apply its mode and modification time.
+func (f *MessageFile) saveDir(dir_path string) error {
+	if info, err := os.Lstat(dir_path); err == nil && !info.IsDir() {
+		return errors.New("directory " + f.Name + " already exists as a file")
+	}
+	if err := os.MkdirAll(dir_path, 0755); err != nil {
+		return err
+	}
+	var perm os.FileMode = 0755
+	if f.Mode.Perm() != 0 {
+		perm = f.Mode.Perm()
+	}
+	if err := os.Chmod(dir_path, perm); err != nil {
+		return err
+	}
+	if !f.ModTime.IsZero() {
+		return os.Chtimes(dir_path, f.ModTime, f.ModTime)
+	}
+	return nil
+}
+
+// SaveAll saves all files of the message to a directory, recreating the directory tree.
+// Every file is saved with SaveWithOptions, so no file is written outside of dest.
+//
+// Directories are created first, their modes and modification times are applied
+// after all files are saved, so read-only directories can still be filled.
+func (m *Message) SaveAll(dest string, opts *SaveOptions) error {
+	var names = make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var dirs = make([]*MessageFile, 0)
+	for _, name := range names {
+		var file = m.Files[name]
+		if !file.IsDir() {
+			continue
+		}
+		dir_path, err := safeFilePath(dest, file.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir_path, 0755); err != nil {
+			return err
+		}
+		dirs = append(dirs, file)
+	}
+	for _, name := range names {
+		var file = m.Files[name]
+		if file.IsDir() {
+			continue
+		}
+		if err := file.SaveWithOptions(dest, opts); err != nil {
+			return err
+		}
+	}
+	// Children before their parents, changing a child changes the modification time of the parent.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := dirs[i].SaveWithOptions(dest, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the file against the size and extension options.
+func (opts *SaveOptions) check(f *MessageFile) error {
+	if opts.MaxSize > 0 && int64(f.Size()) > opts.MaxSize {
+		return errors.New("file " + f.Name + " is larger than the maximum size")
+	}
+	if len(opts.AllowedExtensions) == 0 {
+		return nil
+	}
+	var ext = strings.ToLower(filepath.Ext(f.Name))
+	for _, allowed := range opts.AllowedExtensions {
+		allowed = strings.ToLower(allowed)
+		if !strings.HasPrefix(allowed, ".") {
+			allowed = "." + allowed
+		}
+		if ext == allowed {
+			return nil
+		}
+	}
+	return errors.New("file extension " + ext + " is not allowed")
+}
+
+// Get the path to save a file to, which is guaranteed to be inside of dir.
+func safeFilePath(dir string, name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", errors.New("invalid file name")
+	}
+	// Names are sent by the peer, which might use either separator.
+	var slashed = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errors.New("file name " + name + " is an absolute path")
+	}
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return "", errors.New("file name " + name + " leaves the directory")
+		}
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	var file_path = filepath.Join(root, filepath.FromSlash(slashed))
+	// Directories which already exist might be symlinks to somewhere else.
+	var parent = filepath.Dir(file_path)
+	for parent != root {
+		resolved, err := filepath.EvalSymlinks(parent)
+		if os.IsNotExist(err) {
+			parent = filepath.Dir(parent)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !isInside(root, resolved) {
+			return "", errors.New("file name " + name + " leaves the directory through a symlink")
+		}
+		break
+	}
+	return file_path, nil
+}
+
+// Check if path is inside of root, both must be absolute and clean.
+func isInside(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Write the data of the file to a path.
+func (f *MessageFile) write(file_path string, perm os.FileMode, exclusive bool) error {
+	if f.temp && !exclusive {
+		// Fall back to copying when the file cannot be moved, for example to another device.
+		if err := os.Rename(f.Path, file_path); err == nil {
+			f.setPath(file_path)
+			return nil
+		}
+	}
+	var flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	out, err := os.OpenFile(file_path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if err = f.copyTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if f.temp {
+		os.Remove(f.Path)
+		f.setPath(file_path)
+	}
+	return nil
+}
+
+// Write the data of the file to a temporary file next to the path, and rename it to the path.
+func (f *MessageFile) writeAtomic(file_path string, perm os.FileMode) error {
+	if f.temp {
+		if err := os.Rename(f.Path, file_path); err == nil {
+			f.setPath(file_path)
+			return nil
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file_path), "."+filepath.Base(file_path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err = f.copyTo(tmp); err == nil {
+		if err = tmp.Chmod(perm); err == nil {
+			err = tmp.Close()
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), file_path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if f.temp {
+		os.Remove(f.Path)
+		f.setPath(file_path)
+	}
+	return nil
+}
+
+// Copy the data of the file to w.
+// Files added with a reader can only be read when the message is written, and return an error.
+func (f *MessageFile) copyTo(w io.Writer) error {
+	if f.open == nil && f.reader == nil {
+		_, err := w.Write(f.Data)
+		return err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+// Headers of error responses, see Error.
+const (
+	STATUS_HEADER = "q-status"
+	ERROR_HEADER  = "q-error"
+)
+
+// Status codes of error responses.
+const (
+	StatusBadRequest    = 400
+	StatusUnauthorized  = 401
+	StatusNotFound      = 404
+	StatusInternalError = 500
+	StatusTimeout       = 504
+)
+
+// A Handler responds to a message from a client.
+type Handler interface {
+	ServeQP(w ResponseWriter, req *quickproto.Message)
+}
+
+// HandlerFunc is an adapter to use ordinary functions as handlers.
+type HandlerFunc func(w ResponseWriter, req *quickproto.Message)
+
+// ServeQP calls f(w, req).
+func (f HandlerFunc) ServeQP(w ResponseWriter, req *quickproto.Message) {
+	f(w, req)
+}
+
+// A ResponseWriter is used by a handler to respond to a message.
+type ResponseWriter interface {
+	// NewMessage creates a new message from the configuration of the server,
+	// marked as the response to the request.
+	NewMessage() *quickproto.Message
+	// Write a message to the client.
+	// Messages without a correlation ID are marked as the response to the request.
+	Write(msg *quickproto.Message) error
+	// Client the request was read from.
+	Client() *Client
+	// Server the client is connected to.
+	Server() *Server
+}
+
+// Writes responses to a request.
+type response struct {
+	server *Server
+	client *Client
+	req    *quickproto.Message
+}
+
+func (r *response) NewMessage() *quickproto.Message {
+	var msg = r.server.CONFIG.NewMessage()
+	msg.ReplyTo(r.req)
+	return msg
+}
+
+func (r *response) Write(msg *quickproto.Message) error {
+	if msg.CorrelationID() == "" {
+		msg.ReplyTo(r.req)
+	}
+	return r.server.Write(r.client, msg)
+}
+
+func (r *response) Client() *Client { return r.client }
+func (r *response) Server() *Server { return r.server }
+
+// Error responds with an error message.
+// The status code is sent in the q-status header, the text in the q-error header and the body.
+func Error(w ResponseWriter, code int, text string) error {
+	var msg = w.NewMessage()
+	msg.Headers.Set(STATUS_HEADER, strconv.Itoa(code))
+	msg.Headers.Set(ERROR_HEADER, text)
+	msg.Body = []byte(text)
+	return w.Write(msg)
+}
+
+// NotFound responds with a StatusNotFound error.
+func NotFound(w ResponseWriter, req *quickproto.Message) {
+	Error(w, StatusNotFound, "not found")
+}
+
+// NotFoundHandler returns a handler which responds with a StatusNotFound error.
+func NotFoundHandler() Handler {
+	return HandlerFunc(NotFound)
+}
+
+// ServeMessage passes a message read from a client to the handler.
+func (s *Server) ServeMessage(client *Client, req *quickproto.Message, handler Handler) {
+	handler.ServeQP(&response{server: s, client: client, req: req}, req)
+}
+
+// ServeClient reads messages from a client, and passes them to the handler one at a time.
+// It returns the error which stopped reading, the client is not removed.
+func (s *Server) ServeClient(client *Client, handler Handler) error {
+	for {
+		req, err := s.Read(client)
+		if err != nil {
+			return err
+		}
+		s.ServeMessage(client, req, handler)
+	}
+}
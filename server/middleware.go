@@ -0,0 +1,250 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+// Middleware wraps a handler, to run code before and after it.
+type Middleware func(Handler) Handler
+
+// Returned by writes of a handler which timed out, see Timeout.
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// Chain wraps a handler with middleware.
+// The first middleware is the outermost, it runs first.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Use adds middleware to all handlers of the mux, including NotFound.
+// Middleware runs in the order it was added.
+func (mux *ServeMux) Use(middleware ...Middleware) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.middleware = append(mux.middleware, middleware...)
+}
+
+// A Group registers handlers on a mux with a common pattern prefix and middleware.
+// The middleware of a group runs after the middleware of the mux, and of its parent groups.
+type Group struct {
+	mux        *ServeMux
+	parent     *Group
+	prefix     string
+	mu         sync.RWMutex
+	middleware []Middleware
+}
+
+// Group creates a group of routes, of which the patterns start with prefix.
+func (mux *ServeMux) Group(prefix string, middleware ...Middleware) *Group {
+	return &Group{mux: mux, prefix: prefix, middleware: middleware}
+}
+
+// Group creates a nested group, of which the patterns start with the prefix of g and prefix.
+func (g *Group) Group(prefix string, middleware ...Middleware) *Group {
+	return &Group{mux: g.mux, parent: g, prefix: g.prefix + prefix, middleware: middleware}
+}
+
+// Use adds middleware to all handlers of the group, including those registered earlier.
+func (g *Group) Use(middleware ...Middleware) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.middleware = append(g.middleware, middleware...)
+}
+
+// Handle registers a handler for the prefix of the group followed by pattern.
+func (g *Group) Handle(pattern string, handler Handler) {
+	if handler == nil {
+		panic("server: nil handler for pattern " + g.prefix + pattern)
+	}
+	g.mux.Handle(g.prefix+pattern, HandlerFunc(func(w ResponseWriter, req *quickproto.Message) {
+		g.wrap(handler).ServeQP(w, req)
+	}))
+}
+
+// HandleFunc registers a handler function for the prefix of the group followed by pattern.
+func (g *Group) HandleFunc(pattern string, handler func(w ResponseWriter, req *quickproto.Message)) {
+	g.Handle(pattern, HandlerFunc(handler))
+}
+
+// Wrap a handler with the middleware of the group and its parents.
+func (g *Group) wrap(handler Handler) Handler {
+	g.mu.RLock()
+	handler = Chain(handler, g.middleware...)
+	g.mu.RUnlock()
+	if g.parent != nil {
+		return g.parent.wrap(handler)
+	}
+	return handler
+}
+
+// statusWriter keeps the status of the responses written by a handler.
+type statusWriter struct {
+	ResponseWriter
+	status string
+}
+
+func (w *statusWriter) Write(msg *quickproto.Message) error {
+	if w.status == "" {
+		if w.status = msg.Headers.Get(STATUS_HEADER); w.status == "" {
+			w.status = "ok"
+		}
+	}
+	return w.ResponseWriter.Write(msg)
+}
+
+// Logging logs every message with the address of the client, the message ID,
+// the status of the response and the time it took to handle.
+// A nil logger means log.Default().
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *quickproto.Message) {
+			var start = time.Now()
+			var sw = &statusWriter{ResponseWriter: w}
+			next.ServeQP(sw, req)
+			if sw.status == "" {
+				sw.status = "-"
+			}
+			var addr = "-"
+			if c := w.Client(); c != nil && c.Conn != nil {
+				addr = c.Conn.RemoteAddr().String()
+			}
+			logger.Printf("%s %s %s %s", addr, req.ID(), sw.status, time.Since(start))
+		})
+	}
+}
+
+// Recover recovers panics in handlers, logs them with a stack trace,
+// and responds with a StatusInternalError error.
+// A nil logger means log.Default().
+func Recover(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *quickproto.Message) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Printf("panic handling message %s: %v\n%s", req.ID(), err, debug.Stack())
+					Error(w, StatusInternalError, "internal error")
+				}
+			}()
+			next.ServeQP(w, req)
+		})
+	}
+}
+
+// Auth only passes messages of authenticated clients to the handler,
+// other messages get a StatusUnauthorized error.
+//
+// Clients are authenticated with the value of a cookie. The first time the cookie is seen,
+// authenticate is called with its value, the data it returns is stored in Client.Data.
+// Clients which have Data set are authenticated, set Data to nil to log a client out.
+func Auth(cookie string, authenticate func(client *Client, value string) (any, error)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *quickproto.Message) {
+			var client = w.Client()
+			if client == nil {
+				Error(w, StatusUnauthorized, "unauthorized")
+				return
+			}
+			if client.Data == nil {
+				var value = client.Cookies.Get(cookie)
+				if value == "" {
+					Error(w, StatusUnauthorized, "unauthorized")
+					return
+				}
+				data, err := authenticate(client, value)
+				if err != nil || data == nil {
+					Error(w, StatusUnauthorized, "unauthorized")
+					return
+				}
+				client.Data = data
+			}
+			next.ServeQP(w, req)
+		})
+	}
+}
+
+// timeoutWriter drops the responses of a handler after it timed out.
+type timeoutWriter struct {
+	ResponseWriter
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func (w *timeoutWriter) Write(msg *quickproto.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return ErrHandlerTimeout
+	}
+	return w.ResponseWriter.Write(msg)
+}
+
+// Timeout responds with a StatusTimeout error when a handler does not return within d.
+// The handler keeps running in the background, its writes return ErrHandlerTimeout.
+// Shutdown waits for handlers which are still running in the background to return.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *quickproto.Message) {
+			var tw = &timeoutWriter{ResponseWriter: w}
+			var done = make(chan any, 1)
+			// The goroutine of the client is still tracked by the server, so adding to its wait group here is safe.
+			var s = w.Server()
+			if s != nil {
+				s.wg.Add(1)
+			}
+			go func() {
+				if s != nil {
+					defer s.wg.Done()
+				}
+				defer func() {
+					// Pass panics on to the goroutine of the handler.
+					done <- recover()
+				}()
+				next.ServeQP(tw, req)
+			}()
+			var timer = time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case err := <-done:
+				if err != nil {
+					panic(err)
+				}
+			case <-timer.C:
+				tw.mu.Lock()
+				tw.timedOut = true
+				tw.mu.Unlock()
+				Error(w, StatusTimeout, fmt.Sprintf("handler did not respond within %s", d))
+			}
+		})
+	}
+}
+
+// RequireHeaders responds with a StatusBadRequest error to messages missing any of the headers.
+func RequireHeaders(keys ...string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *quickproto.Message) {
+			for _, key := range keys {
+				if !req.Headers.Has(key) {
+					Error(w, StatusBadRequest, "missing header "+key)
+					return
+				}
+			}
+			next.ServeQP(w, req)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+// Header a ServeMux routes on when it is created with an empty header.
+const DEFAULT_ROUTE_HEADER = "path"
+
+// ServeMux routes messages to handlers, on the value of a header.
+//
+// Patterns are matched in this order:
+//   - Patterns without *, ? or [ match the value exactly.
+//   - Patterns ending in a single *, without other special characters, match every value starting with
+//     the rest of the pattern. The longest matching prefix wins, so "users/*" matches "users/1/posts".
+//   - Other patterns are matched with path.Match, in the order they were registered.
+//
+// Messages which match no pattern are passed to NotFound.
+type ServeMux struct {
+	// Handler for messages which match no pattern, defaults to NotFoundHandler.
+	NotFound Handler
+
+	header     string
+	mu         sync.RWMutex
+	exact      map[string]Handler
+	prefixes   []muxEntry
+	wildcards  []muxEntry
+	middleware []Middleware
+}
+
+type muxEntry struct {
+	pattern string
+	handler Handler
+}
+
+// NewServeMux creates a ServeMux routing on a header, such as "path" or "type".
+// An empty header means DEFAULT_ROUTE_HEADER.
+func NewServeMux(header string) *ServeMux {
+	if header == "" {
+		header = DEFAULT_ROUTE_HEADER
+	}
+	return &ServeMux{
+		header: quickproto.CanonicalHeaderKey(header),
+		exact:  make(map[string]Handler),
+	}
+}
+
+// Header returns the header the mux routes on.
+func (mux *ServeMux) Header() string {
+	return mux.header
+}
+
+// Handle registers a handler for a pattern.
+// It panics if the pattern is invalid or already registered.
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	if handler == nil {
+		panic("server: nil handler for pattern " + pattern)
+	}
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if mux.registered(pattern) {
+		panic("server: multiple registrations for pattern " + pattern)
+	}
+	switch patternKind(pattern) {
+	case patternExact:
+		mux.exact[pattern] = handler
+	case patternPrefix:
+		mux.prefixes = append(mux.prefixes, muxEntry{pattern: strings.TrimSuffix(pattern, "*"), handler: handler})
+		// Longest prefixes first.
+		sort.SliceStable(mux.prefixes, func(i, j int) bool {
+			return len(mux.prefixes[i].pattern) > len(mux.prefixes[j].pattern)
+		})
+	default:
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic("server: invalid pattern " + pattern + ": " + err.Error())
+		}
+		mux.wildcards = append(mux.wildcards, muxEntry{pattern: pattern, handler: handler})
+	}
+}
+
+// HandleFunc registers a handler function for a pattern.
+func (mux *ServeMux) HandleFunc(pattern string, handler func(w ResponseWriter, req *quickproto.Message)) {
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+// Handler returns the handler for a message, and the pattern it matched.
+// The pattern is empty if the message matches no pattern, the handler is then NotFound.
+func (mux *ServeMux) Handler(req *quickproto.Message) (Handler, string) {
+	var value = req.Headers.Get(mux.header)
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	if handler, ok := mux.exact[value]; ok {
+		return handler, value
+	}
+	for _, entry := range mux.prefixes {
+		if strings.HasPrefix(value, entry.pattern) {
+			return entry.handler, entry.pattern + "*"
+		}
+	}
+	for _, entry := range mux.wildcards {
+		if ok, _ := path.Match(entry.pattern, value); ok {
+			return entry.handler, entry.pattern
+		}
+	}
+	if mux.NotFound != nil {
+		return mux.NotFound, ""
+	}
+	return NotFoundHandler(), ""
+}
+
+// ServeQP passes the message to the handler of the pattern it matches, wrapped in the middleware of the mux.
+func (mux *ServeMux) ServeQP(w ResponseWriter, req *quickproto.Message) {
+	handler, _ := mux.Handler(req)
+	mux.mu.RLock()
+	handler = Chain(handler, mux.middleware...)
+	mux.mu.RUnlock()
+	handler.ServeQP(w, req)
+}
+
+// Check if a pattern is already registered.
+func (mux *ServeMux) registered(pattern string) bool {
+	if _, ok := mux.exact[pattern]; ok {
+		return true
+	}
+	for _, entry := range mux.prefixes {
+		if entry.pattern+"*" == pattern {
+			return true
+		}
+	}
+	for _, entry := range mux.wildcards {
+		if entry.pattern == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Kinds of patterns.
+const (
+	patternExact = iota
+	patternPrefix
+	patternWildcard
+)
+
+// Get the kind of a pattern.
+func patternKind(pattern string) int {
+	var i = strings.IndexAny(pattern, "*?[\\")
+	switch {
+	case i < 0:
+		return patternExact
+	case i == len(pattern)-1 && pattern[i] == '*':
+		return patternPrefix
+	}
+	return patternWildcard
+}
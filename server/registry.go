@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Registry holds the clients connected to a server, by ID.
+// It is safe for use by multiple goroutines.
+type Registry struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+	byConn  map[net.Conn]string
+	next    uint64
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		clients: make(map[string]*Client),
+		byConn:  make(map[net.Conn]string),
+	}
+}
+
+// Add a client to the registry, and give it a new ID.
+func (r *Registry) add(client *Client) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	client.ID = strconv.FormatUint(r.next, 10)
+	r.clients[client.ID] = client
+	if client.Conn != nil {
+		r.byConn[client.Conn] = client.ID
+	}
+	return client.ID
+}
+
+// Get returns the client with the ID.
+func (r *Registry) Get(id string) (*Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	client, ok := r.clients[id]
+	return client, ok
+}
+
+// Count returns the number of clients.
+func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients)
+}
+
+// Range calls f for every client, until f returns false.
+// It ranges over a snapshot, so f may add or remove clients.
+func (r *Registry) Range(f func(id string, client *Client) bool) {
+	for _, client := range r.snapshot() {
+		if !f(client.ID, client) {
+			return
+		}
+	}
+}
+
+// Remove removes the client with the ID from the registry, and returns it.
+// The connection of the client is not closed, see Server.RemoveClient.
+func (r *Registry) Remove(id string) (*Client, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[id]
+	if !ok {
+		return nil, false
+	}
+	delete(r.clients, id)
+	if client.Conn != nil {
+		delete(r.byConn, client.Conn)
+	}
+	return client, true
+}
+
+// Remove the client of a connection from the registry.
+func (r *Registry) removeConn(conn net.Conn) (*Client, bool) {
+	r.mu.RLock()
+	id, ok := r.byConn[conn]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return r.Remove(id)
+}
+
+// Get all clients.
+func (r *Registry) snapshot() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var clients = make([]*Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+// Returned by Serve after Shutdown is called.
+var ErrServerClosed = errors.New("server closed")
+
+// Serve accepts clients on the listener, and passes their messages to the handler.
+// Every client gets its own goroutine, which sets up the client and reads its messages one at a time.
+// Clients which disconnect are removed.
+//
+// Serve returns ErrServerClosed after Shutdown is called. When the context is done,
+// the server is shut down, and the error of the context is returned.
+// Listen has to be called before Serve.
+func (s *Server) Serve(ctx context.Context, handler Handler) error {
+	if s.Listener == nil {
+		return errors.New("server is not listening")
+	}
+	var closing = s.closingChan()
+	select {
+	case <-closing:
+		return ErrServerClosed
+	default:
+	}
+	var stop = make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown(context.Background())
+		case <-stop:
+		}
+	}()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			select {
+			case <-closing:
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return ErrServerClosed
+			default:
+			}
+			return err
+		}
+		s.mu.Lock()
+		select {
+		case <-closing:
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		default:
+		}
+		s.conns[conn] = nil
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn, handler, closing)
+	}
+}
+
+// Set up a client for a connection, and pass its messages to the handler until reading fails,
+// or the server is shut down.
+func (s *Server) serveConn(conn net.Conn, handler Handler, closing chan struct{}) {
+	defer s.wg.Done()
+	client, err := s.handshake(conn)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	_, ok := s.conns[conn]
+	if ok {
+		s.conns[conn] = client
+	}
+	s.mu.Unlock()
+	if !ok {
+		// Shutdown gave up waiting, and already closed the other connections.
+		s.RemoveClient(conn)
+		return
+	}
+	for {
+		req, err := s.Read(client)
+		if err != nil {
+			select {
+			case <-closing:
+				// Shutdown sends the close notice, and closes the connection.
+			default:
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				s.RemoveClient(conn)
+			}
+			return
+		}
+		s.ServeMessage(client, req, handler)
+		select {
+		case <-closing:
+			return
+		default:
+		}
+	}
+}
+
+// Shutdown gracefully shuts down a server started with Serve.
+// It stops accepting clients, stops reading messages, and waits for the handlers which are running to return,
+// including handlers which timed out with the Timeout middleware.
+// Then it sends a close notice to every client, a message with the q-close header, and closes all connections.
+//
+// If the context is done before the handlers return, the connections are closed anyway,
+// and the error of the context is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var closing = s.closingChan()
+	s.mu.Lock()
+	select {
+	case <-closing:
+	default:
+		close(closing)
+	}
+	// Interrupt clients waiting for a message.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+
+	var err error
+	var done = make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	var conns = s.conns
+	s.conns = make(map[net.Conn]*Client)
+	s.mu.Unlock()
+	for conn, client := range conns {
+		if client != nil {
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetWriteDeadline(deadline)
+			}
+			var notice = s.CONFIG.NewMessage()
+			notice.Headers.Set(quickproto.CLOSE_HEADER, "shutdown")
+			s.Write(client, notice)
+		}
+		s.RemoveClient(conn)
+	}
+	return err
+}
+
+// Get the channel which is closed when the server shuts down.
+func (s *Server) closingChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing == nil {
+		s.closing = make(chan struct{})
+		s.conns = make(map[net.Conn]*Client)
+	}
+	return s.closing
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"bufio"
 	"errors"
 	"net"
 	"strings"
+	"sync"
 
 	"github.com/Nigel2392/quickproto"
 	simple_rsa "github.com/Nigel2392/simplecrypto/rsa"
@@ -17,36 +19,55 @@ type Server struct {
 	// Listener for connections.
 	Listener net.Listener
 	// General configuration.
-	CONFIG  *quickproto.Config
-	Clients map[string]*Client
+	CONFIG *quickproto.Config
+	// Connected clients, by the ID the server assigned to them.
+	Clients *Registry
+	// Guards the state of Serve.
+	mu sync.Mutex
+	// State of Serve and Shutdown.
+	closing chan struct{}
+	conns   map[net.Conn]*Client
+	wg      sync.WaitGroup
 }
 
 // Server-side client.
 type Client struct {
+	// ID assigned by the server, unique for the server.
+	ID   string
 	Conn net.Conn
 	Key  *[32]byte
 	// Cookies
-	Cookies    map[string][]string
+	Cookies    quickproto.Header
 	delCookies []string
-	setCookies map[string][]string
+	setCookies quickproto.Header
 	// Data is used for storing extra data about the client server side.
 	Data any
+	// Buffered reader for the connection, keeps data of messages which were sent back to back.
+	reader *bufio.Reader
+	// Guards writes to the connection, and the cookies which are sent with them.
+	writeMu sync.Mutex
 }
 
 func (c *Client) AddCookie(key string, value string) {
-	c.setCookies[key] = append(c.setCookies[key], value)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.setCookies.Add(key, value)
 }
 
 func (c *Client) SetCookies(key string, values []string) {
-	c.setCookies[key] = values
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.setCookies[quickproto.CanonicalHeaderKey(key)] = values
 }
 
 func (c *Client) DeleteCookie(key string) {
-	c.delCookies = append(c.delCookies, key)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.delCookies = append(c.delCookies, quickproto.CanonicalHeaderKey(key))
 }
 
 func (c *Client) GetCookie(key string) []string {
-	return c.Cookies[key]
+	return c.Cookies.Values(key)
 }
 
 // Initialize a new server.
@@ -56,7 +77,7 @@ func New(ip string, port any, conf *quickproto.Config) *Server {
 		PORT:     port,
 		Listener: nil,
 		CONFIG:   conf,
-		Clients:  make(map[string]*Client),
+		Clients:  NewRegistry(),
 	}
 }
 
@@ -92,83 +113,105 @@ func (s *Server) Accept() (net.Conn, *Client, error) {
 	if err != nil {
 		return nil, &Client{}, err
 	}
+	client, err := s.handshake(conn)
+	if err != nil {
+		return nil, &Client{}, err
+	}
+	return conn, client, nil
+}
+
+// Set up a client for an accepted connection, and add it to Clients with a new ID.
+func (s *Server) handshake(conn net.Conn) (*Client, error) {
 	// If we are using crypto, the first message sent by the client will be the AES key.
 	// This key will be used to encrypt all future messages.
 	// If we are provided with a private key, we will use it to decrypt the AES key.
 	// If we are not provided with a private key, we will assume that the client is not using RSA encryption.
 	client := &Client{
 		Conn:       conn,
-		Cookies:    make(map[string][]string),
-		setCookies: make(map[string][]string),
+		reader:     quickproto.NewReader(conn, s.CONFIG),
+		Cookies:    make(quickproto.Header),
+		setCookies: make(quickproto.Header),
 		delCookies: make([]string, 0),
 	}
 	if s.CONFIG.UseCrypto {
 		// read aes key from client.
 		msg, err := s.Read(client)
 		if err != nil {
-			return nil, &Client{}, err
+			return nil, err
 		}
 		if s.CONFIG.PrivateKey != nil {
 			if msg.Body, err = quickproto.Base64Decoding(msg.Body); err != nil {
-				return nil, &Client{}, err
+				return nil, err
 			}
 			if msg.Body, err = simple_rsa.Decrypt(msg.Body, s.CONFIG.PrivateKey); err != nil {
-				return nil, &Client{}, err
+				return nil, err
 			}
 		}
-		typ, ok := msg.Headers["type"]
-		if !ok {
-			return nil, &Client{}, errors.New("no type header")
+		if !msg.Headers.Has("type") {
+			return nil, errors.New("no type header")
 		}
-		if typ[0] != "aes_key" {
-			return nil, &Client{}, errors.New("client did not send aes key")
+		if msg.Headers.Get("type") != "aes_key" {
+			return nil, errors.New("client did not send aes key")
 		}
 		// convert key to byte array.
 		aes_key := new([32]byte)
 		copy(aes_key[:], msg.Body)
 		client.Key = aes_key
 	}
-	s.Clients[conn.RemoteAddr().String()] = client
-	return conn, client, nil
+	s.Clients.add(client)
+	return client, nil
 }
 
 // Read a message from a client.
 func (s *Server) Read(client *Client) (*quickproto.Message, error) {
-	msg, err := quickproto.ReadConn(client.Conn, s.CONFIG, client.Key, s.CONFIG.Compressed)
+	if client.reader == nil {
+		client.reader = quickproto.NewReader(client.Conn, s.CONFIG)
+	}
+	msg, err := quickproto.ReadConn(client.reader, s.CONFIG, client.Key, s.CONFIG.Compressed)
 	if err != nil {
 		return nil, err
 	}
 	// Logic for handling cookies.
 	for key, cookie := range msg.Headers {
-		if strings.HasPrefix(key, "Q-COOKIES-") {
-			n_key := strings.TrimPrefix(key, "Q-COOKIES-")
+		if strings.HasPrefix(key, quickproto.COOKIES_PREFIX) {
+			n_key := strings.TrimPrefix(key, quickproto.COOKIES_PREFIX)
 			client.Cookies[n_key] = cookie
-			delete(msg.Headers, key)
+			msg.Headers.Del(key)
 		}
 	}
 	return msg, nil
 }
 
 // Write a message to a client.
+// The message gets a message ID if it has none.
+// It is safe to write to a client from multiple goroutines.
 func (s *Server) Write(client *Client, msg *quickproto.Message) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	msg.EnsureID()
 	for key, cookie := range client.setCookies {
-		msg.Headers["Q-SET-COOKIES-"+key] = append(msg.Headers["Q-SET-COOKIES-"+key], cookie...)
+		for _, value := range cookie {
+			msg.Headers.Add(quickproto.SET_COOKIES_PREFIX+key, value)
+		}
 	}
 	for _, key := range client.delCookies {
-		msg.Headers["Q-DEL-COOKIES-"+key] = []string{"\x00"}
+		msg.Headers.Set(quickproto.DEL_COOKIES_PREFIX+key, "\x00")
 	}
+	msg.Framing = s.CONFIG.Framing
 	return quickproto.WriteConn(client.Conn, msg, client.Key, s.CONFIG.Compressed)
 }
 
-// Close a client connection.
+// Close a client connection, and remove the client from Clients.
 func (s *Server) RemoveClient(conn net.Conn) error {
-	delete(s.Clients, conn.RemoteAddr().String())
+	s.Clients.removeConn(conn)
 	return conn.Close()
 }
 
 // Broadcast a message to all clients.
+// It is safe to broadcast while clients are accepted and removed,
+// clients which are added during the broadcast may not get the message.
 func (s *Server) Broadcast(msg *quickproto.Message) error {
-	for _, client := range s.Clients {
+	for _, client := range s.Clients.snapshot() {
 		if err := s.Write(client, msg); err != nil {
 			return err
 		}
@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func archiveTestMessage() *quickproto.Message {
+	var mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	file := quickproto.NewMessageFile("dir/file1.txt", []byte("FILE1&&&&&&&&"))
+	file.Mode = 0600
+	file.ModTime = mtime
+	msg.AddFile(file)
+	msg.AddRawFile("file2", []byte("FILE2"))
+	msg.AddFile(&quickproto.MessageFile{Name: "dir", Mode: fs.ModeDir | 0700, ModTime: mtime})
+	return msg
+}
+
+func validateArchive(t *testing.T, name string, msg *quickproto.Message) {
+	if len(msg.Files) != 3 {
+		t.Fatalf("(%s) Expected 3 files, got %v", name, msg.Files)
+	}
+	var file = msg.Files["dir/file1.txt"]
+	if file == nil || string(file.Data) != "FILE1&&&&&&&&" {
+		t.Fatalf("(%s) Expected dir/file1.txt to be FILE1&&&&&&&&, got %v", name, file)
+	}
+	if file.Mode.Perm() != 0600 || !file.ModTime.Equal(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("(%s) Expected mode and modification time to be kept, got %v %v", name, file.Mode, file.ModTime)
+	}
+	if !msg.Files["dir"].IsDir() || msg.Files["dir"].Mode.Perm() != 0700 {
+		t.Errorf("(%s) Expected dir to be a directory with mode 0700, got %v", name, msg.Files["dir"].Mode)
+	}
+	if string(msg.Files["file2"].Data) != "FILE2" {
+		t.Errorf("(%s) Expected file2 to be FILE2", name)
+	}
+	// Archived files can be sent like any other file.
+	sendMessage(t, msg)
+}
+
+func TestZip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := archiveTestMessage().WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	if err := msg.AddZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatal(err)
+	}
+	validateArchive(t, "zip", msg)
+}
+
+func TestArchiveStreamedFile(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.AddFileReader("stream.bin", strings.NewReader("STREAM"), 6)
+	if err := msg.WriteZip(io.Discard); err == nil {
+		t.Error("Expected WriteZip to fail for a file added with a reader")
+	}
+	if err := msg.WriteTar(io.Discard); err == nil {
+		t.Error("Expected WriteTar to fail for a file added with a reader")
+	}
+}
+
+func TestTar(t *testing.T) {
+	var buf bytes.Buffer
+	if err := archiveTestMessage().WriteTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	if err := msg.AddTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	validateArchive(t, "tar", msg)
+}
@@ -208,3 +208,19 @@ func BenchmarkPlainParse(b *testing.B) {
 		msg.Parse()
 	}
 }
+
+func BenchmarkFileParse(b *testing.B) {
+	for _, alg := range []quickproto.ChecksumAlgorithm{quickproto.ChecksumNone, quickproto.ChecksumCRC32, quickproto.ChecksumSHA256} {
+		b.Run(string(alg), func(b *testing.B) {
+			msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+			msg.ChecksumAlgorithm = alg
+			msg.Headers = Predef_HEADERS
+			msg.AddRawFile("file", Predef_BODY)
+			msg.Generate()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg.Parse()
+			}
+		})
+	}
+}
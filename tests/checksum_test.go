@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func b64Encode(data []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(data))
+}
+
+func b64Decode(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(string(data))
+}
+
+func TestFileChecksums(t *testing.T) {
+	for _, alg := range []quickproto.ChecksumAlgorithm{"", quickproto.ChecksumSHA256, quickproto.ChecksumCRC32} {
+		conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+		conf.ChecksumAlgorithm = alg
+		msg := conf.NewMessage()
+		msg.AddRawFile("file1", []byte("FILE1DATA"))
+		msg.AddRawFile("file2", []byte("FILE2DATA"))
+		msg.Generate()
+
+		newmsg := conf.NewMessage()
+		newmsg.Data = msg.Data
+		if _, err := newmsg.Parse(); err != nil {
+			t.Fatalf("(%q) %v", alg, err)
+		}
+		var prefix = "crc32:"
+		if alg == quickproto.ChecksumSHA256 {
+			prefix = "sha256:"
+		}
+		if !strings.HasPrefix(newmsg.Files["file1"].Checksum, prefix) {
+			t.Errorf("(%q) Expected a %s checksum, got %q", alg, prefix, newmsg.Files["file1"].Checksum)
+		}
+
+		// Tamper with the data of file2.
+		var data = bytes.Replace(msg.Data, []byte("FILE2DATA"), []byte("FILE2DATX"), 1)
+		newmsg = conf.NewMessage()
+		newmsg.Data = data
+		var checksumErr *quickproto.ChecksumError
+		if _, err := newmsg.Parse(); !errors.As(err, &checksumErr) {
+			t.Fatalf("(%q) Expected a ChecksumError, got %v", alg, err)
+		}
+		if checksumErr.File != "file2" || !strings.HasPrefix(checksumErr.Actual, prefix) {
+			t.Errorf("(%q) Expected the error to name file2, got %v", alg, checksumErr)
+		}
+		_, err := quickproto.NewDecoder(bytes.NewReader(data), conf).Decode()
+		if !errors.As(err, &checksumErr) || checksumErr.File != "file2" {
+			t.Errorf("(%q) Expected the decoder to return a ChecksumError for file2, got %v", alg, err)
+		}
+	}
+}
+
+func TestFileChecksumNone(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	conf.ChecksumAlgorithm = quickproto.ChecksumNone
+	msg := conf.NewMessage()
+	msg.AddRawFile("file1", []byte("FILE1DATA"))
+	msg.Generate()
+	newmsg := conf.NewMessage()
+	newmsg.Data = bytes.Replace(msg.Data, []byte("FILE1DATA"), []byte("FILE1DATX"), 1)
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if newmsg.Files["file1"].Checksum != "" {
+		t.Errorf("Expected no checksum, got %q", newmsg.Files["file1"].Checksum)
+	}
+}
+
+func TestMessageChecksum(t *testing.T) {
+	var configs = map[string]*quickproto.Config{
+		"plain":   quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil),
+		"escaped": quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil),
+		"encoded": quickproto.NewConfig([]byte("&"), true, false, 4096, b64Encode, b64Decode),
+		"crc32":   quickproto.NewConfig([]byte("###"), false, false, 4096, nil, nil),
+	}
+	configs["escaped"].Escape = true
+	configs["crc32"].ChecksumAlgorithm = quickproto.ChecksumCRC32
+	for name, conf := range configs {
+		conf.MessageChecksum = true
+		msg := generateTestMessage(conf, 0)
+
+		newmsg := conf.NewMessage()
+		newmsg.Data = msg.Data
+		if _, err := newmsg.Parse(); err != nil {
+			t.Fatalf("(%s) %v", name, err)
+		}
+		validateDecoded(t, name+" parse", msg, newmsg)
+
+		// The decoder removes the trailer from the body.
+		decoded, err := quickproto.NewDecoder(bytes.NewReader(msg.Data), conf).Decode()
+		if err != nil {
+			t.Fatalf("(%s) %v", name, err)
+		}
+		validateDecoded(t, name+" decoder", msg, decoded)
+
+		// Tamper with a header.
+		newmsg = conf.NewMessage()
+		newmsg.Data = bytes.Replace(msg.Data, []byte("value2"), []byte("value3"), 1)
+		if name == "encoded" {
+			continue
+		}
+		var checksumErr *quickproto.ChecksumError
+		if _, err := newmsg.Parse(); !errors.As(err, &checksumErr) || checksumErr.File != "" {
+			t.Errorf("(%s) Expected a message ChecksumError, got %v", name, err)
+		}
+	}
+
+	// A trailer is required when MessageChecksum is set.
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	msg := generateTestMessage(conf, 0)
+	conf.MessageChecksum = true
+	newmsg := conf.NewMessage()
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err == nil {
+		t.Error("Expected an error when the message checksum is missing")
+	}
+}
+
+func TestMessageChecksumStream(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	conf.MessageChecksum = true
+	for _, body := range []string{strings.Repeat("BODY&", 10000), ""} {
+		msg := conf.NewMessage()
+		msg.Body = []byte(body)
+		msg.Generate()
+		var r = io.MultiReader(bytes.NewReader(msg.Data), bytes.NewReader(msg.Data))
+		var d = quickproto.NewDecoder(r, conf)
+		for i := 0; i < 2; i++ {
+			decoded, err := d.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded.Body, msg.Body) {
+				t.Fatalf("Expected body of message %d to round trip, got %d bytes", i, len(decoded.Body))
+			}
+		}
+	}
+}
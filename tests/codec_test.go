@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+type codecValue struct {
+	Name  string
+	Items []int
+}
+
+// Codec which stores JSON in upper case, to check that registered codecs are used.
+type upperJSONCodec struct{}
+
+func (upperJSONCodec) ContentType() string { return "application/x-upper-json" }
+
+func (upperJSONCodec) Marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return []byte(strings.ToUpper(string(data))), err
+}
+
+func (upperJSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestCodecs(t *testing.T) {
+	quickproto.RegisterCodec(upperJSONCodec{})
+	var codecs = []quickproto.Codec{quickproto.JSONCodec, quickproto.GobCodec, quickproto.XMLCodec, upperJSONCodec{}}
+	for _, codec := range codecs {
+		conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+		conf.Codec = codec
+		msg := conf.NewMessage()
+		var v = codecValue{Name: "name", Items: []int{1, 2, 3}}
+		if err := msg.SetBodyValue(v); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msg.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		// The receiving side does not know the codec, it is picked from the content-type header.
+		newmsg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+		newmsg.Data = msg.Data
+		if _, err := newmsg.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		if newmsg.Codec == nil || newmsg.Codec.ContentType() != codec.ContentType() {
+			t.Fatalf("(%s) Expected codec to be picked from the content-type header, got %v", codec.ContentType(), newmsg.Codec)
+		}
+		var newv codecValue
+		if err := newmsg.DecodeBody(&newv); err != nil {
+			t.Fatalf("(%s) %v", codec.ContentType(), err)
+		}
+		if strings.ToUpper(v.Name) != strings.ToUpper(newv.Name) || len(newv.Items) != 3 {
+			t.Errorf("(%s) Expected %v, got %v", codec.ContentType(), v, newv)
+		}
+	}
+}
+
+func TestCodecContentTypeHeader(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Codec = quickproto.XMLCodec
+	msg.Body = []byte("<codecValue><Name>name</Name></codecValue>")
+	msg.Generate()
+	if msg.Headers.Get("content-type") != "application/xml" {
+		t.Errorf("Expected Generate to set the content-type header, got %q", msg.Headers.Get("content-type"))
+	}
+	msg = quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.AddHeader("Content-Type", "application/json; charset=utf-8")
+	msg.Body = []byte(`{"Name":"name"}`)
+	var v codecValue
+	if err := msg.DecodeBody(&v); err != nil || v.Name != "name" {
+		t.Errorf("Expected name to be decoded with the JSON codec, got %v (%v)", v, err)
+	}
+	msg.Headers.Set("content-type", "application/unknown")
+	if err := msg.DecodeBody(&v); err == nil {
+		t.Error("Expected an error for an unknown content type")
+	}
+}
@@ -16,7 +16,9 @@ import (
 	simple_rsa "github.com/Nigel2392/simplecrypto/rsa"
 )
 
-// This test is not race condition safe, do not run with --race!
+// The server and client are safe for concurrent use, but this test itself is not race condition safe:
+// the goroutines read CONNTYPE and ct while the loops change them,
+// and append to FAILED_DELIMITERS without holding mu. Do not run with --race!
 func TestConnection(t *testing.T) {
 	var UseB64 []bool = []bool{false, true}
 	var CONNTYPE string = "udp"
@@ -180,13 +182,13 @@ func TestConnection(t *testing.T) {
 					t.Log(strings.Repeat("-", 50))
 					if !hasBody {
 						// Validate
-						if newmsg.Headers["Test"][0] != "Test" {
+						if newmsg.Headers.Get("Test") != "Test" {
 							FAILED_DELIMITERS = append(FAILED_DELIMITERS, errors.New("Current Delimiter:"+DELIMITER+"\nHeader Test not equal to Test"))
 						}
-						if newmsg.Headers["Test2"][0] != "Test2" {
+						if newmsg.Headers.Get("Test2") != "Test2" {
 							FAILED_DELIMITERS = append(FAILED_DELIMITERS, errors.New("Current Delimiter:"+DELIMITER+"\nHeader Test2 not equal to Test2"))
 						}
-						if newmsg.Headers["Test3"][0] != "Test3" {
+						if newmsg.Headers.Get("Test3") != "Test3" {
 							FAILED_DELIMITERS = append(FAILED_DELIMITERS, errors.New("Current Delimiter:"+DELIMITER+"\nHeader Test3 not equal to Test3"))
 						}
 						if newmsg.Files["test.txt"] == nil {
@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func generateTestMessage(conf *quickproto.Config, i int) *quickproto.Message {
+	msg := conf.NewMessage()
+	msg.AddHeader("key1", "value1")
+	msg.AddHeader("key1", "value2")
+	msg.AddHeader("key2", strings.Repeat("value", i+1))
+	msg.AddRawFile("file1", []byte("FILE1"))
+	msg.AddRawFile("file2", []byte("!@#$%^&*()$$$$$$$$FILE2"))
+	if i%2 == 0 {
+		msg.Body = []byte(strings.Repeat("BODYBODYBODY", i+1))
+	}
+	msg.Generate()
+	return msg
+}
+
+func validateDecoded(t *testing.T, name string, msg *quickproto.Message, newmsg *quickproto.Message) {
+	if len(newmsg.Headers["key1"]) != 2 || newmsg.Headers["key1"][0] != "value1" || newmsg.Headers["key1"][1] != "value2" {
+		t.Errorf("(%s) Expected key1 to be [value1 value2], got %v", name, newmsg.Headers["key1"])
+	}
+	if len(newmsg.Headers["key2"]) != 1 || newmsg.Headers["key2"][0] != msg.Headers["key2"][0] {
+		t.Errorf("(%s) Expected key2 to be %v, got %v", name, msg.Headers["key2"], newmsg.Headers["key2"])
+	}
+	for fname, file := range msg.Files {
+		if newmsg.Files[fname] == nil {
+			t.Errorf("(%s) Expected file %s to exist", name, fname)
+		} else if !bytes.Equal(newmsg.Files[fname].Data, file.Data) {
+			t.Errorf("(%s) Expected file %s to be %q, got %q", name, fname, file.Data, newmsg.Files[fname].Data)
+		}
+	}
+	if !bytes.Equal(newmsg.Body, msg.Body) {
+		t.Errorf("(%s) Expected body to be %q, got %q", name, msg.Body, newmsg.Body)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	for _, delimiter := range []string{"&", "###"} {
+		for _, useencoding := range []bool{false, true} {
+			for _, escape := range []bool{false, true} {
+				conf := quickproto.NewConfig([]byte(delimiter), useencoding, false, 16, quickproto.Base64Encoding, quickproto.Base64Decoding)
+				conf.Escape = escape
+				var stream bytes.Buffer
+				var messages []*quickproto.Message
+				for i := 0; i < 5; i++ {
+					msg := generateTestMessage(conf, i)
+					stream.Write(msg.Data)
+					messages = append(messages, msg)
+				}
+				// Read one byte at a time, so delimiters are split over reads.
+				decoder := quickproto.NewDecoder(iotest.OneByteReader(&stream), conf)
+				for i, msg := range messages {
+					newmsg, err := decoder.Decode()
+					if err != nil {
+						t.Fatalf("(%q, encoding: %v, escape: %v) message %d: %v", delimiter, useencoding, escape, i, err)
+					}
+					validateDecoded(t, delimiter, msg, newmsg)
+				}
+				if _, err := decoder.Decode(); err != io.EOF {
+					t.Errorf("(%q, encoding: %v, escape: %v) Expected io.EOF after the last message, got %v", delimiter, useencoding, escape, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDecoderParts(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	msg := conf.NewMessage()
+	msg.AddHeader("key1", "value1")
+	msg.AddRawFile("file1", []byte("FILE1"))
+	msg.Body = []byte(strings.Repeat("BODYBODYBODY_", 100000))
+	msg.Generate()
+
+	decoder := quickproto.NewDecoder(bytes.NewReader(msg.Data), conf)
+	key, values, err := decoder.NextHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "key1" || len(values) != 1 || values[0] != "value1" {
+		t.Errorf("Expected header key1=[value1], got %s=%v", key, values)
+	}
+	if _, _, err := decoder.NextHeader(); err != io.EOF {
+		t.Fatalf("Expected io.EOF after the last header, got %v", err)
+	}
+	part, err := decoder.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.IsBody || part.Name != "file1" {
+		t.Fatalf("Expected part to be file1, got %q (body: %v)", part.Name, part.IsBody)
+	}
+	// Leave the file unread, NextPart should skip it.
+	part, err = decoder.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !part.IsBody {
+		t.Fatalf("Expected part to be the body, got file %q", part.Name)
+	}
+	var n int64
+	var buf = make([]byte, 1000)
+	for {
+		m, err := part.Read(buf)
+		if m > 0 && !bytes.Equal(buf[:m], msg.Body[n:n+int64(m)]) {
+			t.Fatalf("Body mismatch at offset %d", n)
+		}
+		n += int64(m)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != int64(len(msg.Body)) {
+		t.Errorf("Expected body of %d bytes, got %d", len(msg.Body), n)
+	}
+	if _, err := decoder.NextPart(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the body, got %v", err)
+	}
+}
+
+func TestDecoderHeadersFirst(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	msg := conf.NewMessage()
+	msg.AddHeader("key1", "value1")
+	msg.Body = []byte("BODYBODYBODY")
+	msg.Generate()
+
+	reader, writer := io.Pipe()
+	decoder := quickproto.NewDecoder(reader, conf)
+	// Only send the first header, the decoder should return it without waiting for the rest.
+	var split = bytes.Index(msg.Data, []byte("&&")) + 2
+	go writer.Write(msg.Data[:split])
+	key, values, err := decoder.NextHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "key1" || values[0] != "value1" {
+		t.Errorf("Expected header key1=[value1], got %s=%v", key, values)
+	}
+	go func() {
+		writer.Write(msg.Data[split:])
+		writer.Close()
+	}()
+	if _, _, err := decoder.NextHeader(); err != io.EOF {
+		t.Fatalf("Expected io.EOF after the last header, got %v", err)
+	}
+	part, err := decoder.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "BODYBODYBODY" {
+		t.Errorf("Expected body to be BODYBODYBODY, got %q", body)
+	}
+}
+
+func TestDecoderMatchesParse(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("$"), false, false, 2048, nil, nil)
+	for _, data := range []string{
+		"key$value$$$$key$$false$$value$$$$$$$$",
+		"key$value$$$$key$$false$$value$$$$$$\x00$$$$$$$$",
+		"key$value$$$$file$$false$$data$$$$$$key$$false$$value$$$$$$$$",
+	} {
+		parsed := conf.NewMessage()
+		parsed.Data = []byte(data)
+		if _, err := parsed.Parse(); err != nil {
+			t.Fatalf("(%q) %v", data, err)
+		}
+		decoded, err := quickproto.NewDecoder(strings.NewReader(data), conf).Decode()
+		if err != nil {
+			t.Fatalf("(%q) %v", data, err)
+		}
+		if !bytes.Equal(decoded.Body, parsed.Body) {
+			t.Errorf("(%q) Expected body %q, got %q", data, parsed.Body, decoded.Body)
+		}
+		if len(decoded.Files) != len(parsed.Files) {
+			t.Errorf("(%q) Expected %d files, got %d", data, len(parsed.Files), len(decoded.Files))
+		}
+		for name, file := range parsed.Files {
+			if decoded.Files[name] == nil || !bytes.Equal(decoded.Files[name].Data, file.Data) {
+				t.Errorf("(%q) Expected file %q to be %q", data, name, file.Data)
+			}
+		}
+	}
+}
+
+func TestDecoderSpillCleanup(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	conf.SpillThreshold = 8
+	conf.SpillDir = t.TempDir()
+	msg := conf.NewMessage()
+	msg.AddRawFile("a", []byte("AAAAAAAAAAAAAAAA"))
+	msg.AddRawFile("b", []byte("BBBBBBBBBBBBBBBB"))
+	msg.Generate()
+
+	// Invalid data in the second file removes the first spilled file.
+	var invalid = bytes.Replace(msg.Data, []byte("false&&BBBBBBBBBBBBBBBB"), []byte("base64&&!!!!"), 1)
+	if _, err := quickproto.NewDecoder(bytes.NewReader(invalid), conf).Decode(); err == nil {
+		t.Fatal("Expected an error for invalid base64 data")
+	}
+	if entries, _ := os.ReadDir(conf.SpillDir); len(entries) != 0 {
+		t.Errorf("Expected the spilled files to be removed, found %d", len(entries))
+	}
+
+	// A file with the same name replaces the spilled file.
+	var duplicate = bytes.Replace(msg.Data, []byte("&&b&"), []byte("&&a&"), 1)
+	decoded, err := quickproto.NewDecoder(bytes.NewReader(duplicate), conf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(conf.SpillDir); len(entries) != 1 {
+		t.Errorf("Expected only the last file to be kept, found %d", len(entries))
+	}
+	decoded.Close()
+	if entries, _ := os.ReadDir(conf.SpillDir); len(entries) != 0 {
+		t.Errorf("Expected Close to remove all temporary files, found %d", len(entries))
+	}
+
+	// Parse does the same.
+	var parsed = conf.NewMessage()
+	parsed.Data = duplicate
+	if _, err := parsed.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(conf.SpillDir); len(entries) != 1 {
+		t.Errorf("Expected Parse to keep only the last file, found %d", len(entries))
+	}
+	parsed.Close()
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+// Send a message, and parse it on the other side.
+func sendMessage(t *testing.T, msg *quickproto.Message) *quickproto.Message {
+	if _, err := msg.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	newmsg := quickproto.NewMessage(msg.Delimiter, false, nil, nil)
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	return newmsg
+}
+
+func TestAddDir(t *testing.T) {
+	var src = t.TempDir()
+	var write = func(name string, data string, perm os.FileMode) {
+		var p = filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("app.conf", "key=value", 0644)
+	write("secrets/token", "TOKEN&&&&&&&&", 0600)
+	write("readonly/file", "READONLY", 0644)
+	if err := os.MkdirAll(filepath.Join(src, "empty"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(src, "readonly"), 0755) })
+
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	if err := msg.AddDir(src); err != nil {
+		t.Fatal(err)
+	}
+	newmsg := sendMessage(t, msg)
+	if !newmsg.Files["empty"].IsDir() || newmsg.Files["empty"].Mode.Perm() != 0750 {
+		t.Errorf("Expected empty to be a directory with mode 0750, got %v", newmsg.Files["empty"].Mode)
+	}
+
+	var dest = t.TempDir()
+	if err := newmsg.SaveAll(dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(dest, "readonly"), 0755) })
+	for name, data := range map[string]string{"app.conf": "key=value", "secrets/token": "TOKEN&&&&&&&&", "readonly/file": "READONLY"} {
+		got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(got) != data {
+			t.Errorf("Expected %s to be %q, got %q (%v)", name, data, got, err)
+		}
+	}
+	var modes = map[string]os.FileMode{"secrets/token": 0600, "empty": os.ModeDir | 0750, "readonly": os.ModeDir | 0555}
+	for name, mode := range modes {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&(os.ModeDir|os.ModePerm) != mode {
+			t.Errorf("Expected mode of %s to be %v, got %v", name, mode, info.Mode())
+		}
+	}
+}
+
+func TestAddFS(t *testing.T) {
+	var mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	var fsys = fstest.MapFS{
+		"a.txt":       {Data: []byte("A"), Mode: 0640, ModTime: mtime},
+		"dir/b.txt":   {Data: []byte("B&&&&"), Mode: 0644, ModTime: mtime},
+		"dir/empty":   {Mode: os.ModeDir | 0700, ModTime: mtime},
+		"dir/c/d.txt": {Data: []byte("D"), ModTime: mtime},
+	}
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	if err := msg.AddFS(fsys); err != nil {
+		t.Fatal(err)
+	}
+	newmsg := sendMessage(t, msg)
+	for _, name := range []string{"a.txt", "dir", "dir/b.txt", "dir/empty", "dir/c", "dir/c/d.txt"} {
+		if newmsg.Files[name] == nil {
+			t.Errorf("Expected %s to be sent", name)
+		}
+	}
+	if string(newmsg.Files["dir/b.txt"].Data) != "B&&&&" || newmsg.Files["a.txt"].Mode != 0640 {
+		t.Errorf("Expected files to keep their data and modes")
+	}
+	var dest = t.TempDir()
+	if err := newmsg.SaveAll(dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "dir", "empty")); err != nil || !info.IsDir() || !info.ModTime().Equal(mtime) {
+		t.Errorf("Expected dir/empty to be created with its modification time, got %v (%v)", info, err)
+	}
+}
+
+func TestSaveAllTraversal(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.AddRawFile("../outside", []byte("OUTSIDE"))
+	if err := msg.SaveAll(t.TempDir(), nil); err == nil {
+		t.Error("Expected SaveAll to reject files outside of the destination")
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	for _, escape := range []bool{false, true} {
+		msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+		msg.Escape = escape
+		msg.AddRawFile("empty", []byte{})
+		msg.AddRawFile("null", []byte{0x00})
+		msg.AddFileReader("reader", bytes.NewReader(nil), 0)
+		msg.Body = []byte("BODY")
+		newmsg := sendMessage(t, msg)
+		decoded, err := quickproto.NewDecoder(bytes.NewReader(msg.Data), quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)).Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, m := range map[string]*quickproto.Message{"parse": newmsg, "decoder": decoded} {
+			if m.Files["empty"] == nil || len(m.Files["empty"].Data) != 0 {
+				t.Errorf("(%s, escape: %v) Expected empty to be empty, got %v", name, escape, m.Files["empty"])
+			}
+			if m.Files["reader"] == nil || len(m.Files["reader"].Data) != 0 {
+				t.Errorf("(%s, escape: %v) Expected reader to be empty, got %v", name, escape, m.Files["reader"])
+			}
+			if m.Files["null"] == nil || !bytes.Equal(m.Files["null"].Data, []byte{0x00}) {
+				t.Errorf("(%s, escape: %v) Expected null to be a NULL byte, got %v", name, escape, m.Files["null"])
+			}
+			if string(m.Body) != "BODY" {
+				t.Errorf("(%s, escape: %v) Expected body to be BODY, got %q", name, escape, m.Body)
+			}
+		}
+	}
+}
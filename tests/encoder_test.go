@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func TestWriteTo(t *testing.T) {
+	for _, useencoding := range []bool{false, true} {
+		for _, escape := range []bool{false, true} {
+			msg := quickproto.NewMessage([]byte("&"), useencoding, quickproto.Base64Encoding, quickproto.Base64Decoding)
+			msg.Escape = escape
+			msg.AddHeader("key1", "value1")
+			msg.AddHeader("key1", "value2")
+			msg.AddRawFile("file1", []byte("!@#$%^&*()&&&&&&&&FILE1"))
+			msg.Body = []byte("BODYBODYBODY")
+
+			var buf bytes.Buffer
+			n, err := msg.WriteTo(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("(encoding: %v, escape: %v) Expected WriteTo to return %d, got %d", useencoding, escape, buf.Len(), n)
+			}
+			msg.Generate()
+			if !bytes.Equal(buf.Bytes(), msg.Data) {
+				t.Errorf("(encoding: %v, escape: %v) Expected WriteTo to write %q, got %q", useencoding, escape, msg.Data, buf.Bytes())
+			}
+		}
+	}
+}
+
+func TestWriteToFileReader(t *testing.T) {
+	var fdata = []byte(strings.Repeat("FILE&&&&&&&&DATA=\x00", 50000))
+	for _, escape := range []bool{false, true} {
+		for _, enc := range []string{"base64", "base32", "hex"} {
+			msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+			msg.Escape = escape
+			msg.FileEncoding = enc
+			msg.AddHeader("key1", "value1")
+			file := quickproto.NewMessageFileReader("file1", bytes.NewReader(fdata))
+			msg.AddFile(file)
+			msg.Body = []byte("BODYBODYBODY")
+
+			var buf bytes.Buffer
+			if _, err := msg.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			newmsg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+			newmsg.Data = buf.Bytes()
+			if _, err := newmsg.Parse(); err != nil {
+				t.Fatalf("(escape: %v) %v", escape, err)
+			}
+			if newmsg.Files["file1"] == nil || !bytes.Equal(newmsg.Files["file1"].Data, fdata) {
+				t.Errorf("(escape: %v) Expected file1 to round trip", escape)
+			}
+			if string(newmsg.Body) != "BODYBODYBODY" {
+				t.Errorf("(escape: %v) Expected body to be BODYBODYBODY, got %q", escape, newmsg.Body)
+			}
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	var stream bytes.Buffer
+	var encoder = quickproto.NewEncoder(&stream)
+	var messages []*quickproto.Message
+	for i := 0; i < 5; i++ {
+		msg := generateTestMessage(conf, i)
+		if err := encoder.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msg)
+	}
+	decoder := quickproto.NewDecoder(&stream, conf)
+	for i, msg := range messages {
+		newmsg, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		validateDecoded(t, "encoder", msg, newmsg)
+	}
+}
+
+func TestWriteConnStream(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	var body = []byte(strings.Repeat("BODYBODYBODY_", 10000))
+	go func() {
+		msg := conf.NewMessage()
+		msg.AddHeader("key1", "value1")
+		msg.Body = body
+		if err := quickproto.WriteConn(client, msg, nil, false); err != nil {
+			t.Error(err)
+		}
+	}()
+	msg, err := quickproto.ReadConn(server, conf, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers["key1"][0] != "value1" {
+		t.Error("Expected key1 to be value1")
+	}
+	if !bytes.Equal(msg.Body, body) {
+		t.Error("Expected body to round trip")
+	}
+}
+
+func TestFileEncodings(t *testing.T) {
+	// Reverses the data, and marks every byte with a "~".
+	quickproto.RegisterFileEncoding("reversed", func(data []byte) []byte {
+		var out = make([]byte, 0, len(data)*2)
+		for i := len(data) - 1; i >= 0; i-- {
+			out = append(out, '~', data[i])
+		}
+		return out
+	}, func(data []byte) ([]byte, error) {
+		var out = make([]byte, 0, len(data)/2)
+		for i := len(data) - 1; i > 0; i -= 2 {
+			out = append(out, data[i])
+		}
+		return out, nil
+	})
+	var fdata = []byte("FILE&&&&&&&&DATA")
+	for _, enc := range []string{"base64", "base32", "hex", "reversed"} {
+		conf := quickproto.NewConfig([]byte("$"), false, false, 2048, nil, nil)
+		conf.FileEncoding = enc
+		msg := conf.NewMessage()
+		msg.AddRawFile("file1", bytes.Replace(fdata, []byte("&"), []byte("$"), -1))
+		msg.AddRawFile("plain", []byte("PLAIN"))
+		if _, err := msg.Generate(); err != nil {
+			t.Fatalf("(%s) %v", enc, err)
+		}
+		if !bytes.Contains(msg.Data, []byte("$$"+enc+"$$")) || !bytes.Contains(msg.Data, []byte("$$false$$PLAIN")) {
+			t.Errorf("(%s) Expected files to be sent with the encoding name, got %q", enc, msg.Data)
+		}
+		newmsg := quickproto.NewMessage([]byte("$"), false, nil, nil)
+		newmsg.Data = msg.Data
+		if _, err := newmsg.Parse(); err != nil {
+			t.Fatalf("(%s) %v", enc, err)
+		}
+		decoded, err := quickproto.NewDecoder(bytes.NewReader(msg.Data), conf).Decode()
+		if err != nil {
+			t.Fatalf("(%s) %v", enc, err)
+		}
+		for name, m := range map[string]*quickproto.Message{"parse": newmsg, "decoder": decoded} {
+			if !bytes.Equal(m.Files["file1"].Data, msg.Files["file1"].Data) || string(m.Files["plain"].Data) != "PLAIN" {
+				t.Errorf("(%s, %s) Expected files to round trip", enc, name)
+			}
+		}
+	}
+
+	// Files sent by older versions are flagged with "true", and decoded with F_Decoder.
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Data = []byte("key1&value1&&&&file1&&true&&" + string(quickproto.Base64Encoding(fdata)) + "&&&&&&BODY")
+	if _, err := msg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Files["file1"].Data, fdata) {
+		t.Errorf("Expected the legacy file to be decoded, got %q", msg.Files["file1"].Data)
+	}
+
+	msg = quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.FileEncoding = "unknown"
+	msg.AddRawFile("file1", fdata)
+	if _, err := msg.Generate(); err == nil {
+		t.Error("Expected an error for an unknown file encoding")
+	}
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func TestEscapeRoundTrip(t *testing.T) {
+	for _, delimiter := range []string{"&", "###", "$", "\x1b"} {
+		for _, useencoding := range []bool{false, true} {
+			conf := quickproto.NewConfig([]byte(delimiter), useencoding, false, 2048, quickproto.Base64Encoding, quickproto.Base64Decoding)
+			conf.Escape = true
+			var (
+				key   = "key" + delimiter + "1"
+				value = delimiter + "value=1" + delimiter + delimiter
+				fname = "file" + delimiter + "name=.txt"
+				fdata = []byte("\x00DATA" + delimiter + delimiter + "=AA" + delimiter)
+				body  = []byte(delimiter + "BODY\x00=BODY" + delimiter + delimiter + delimiter)
+			)
+			msg := conf.NewMessage()
+			if err := msg.AddHeader(key, value); err != nil {
+				t.Fatal(err)
+			}
+			msg.AddHeader(key, "value2")
+			msg.AddRawFile(fname, fdata)
+			msg.Body = body
+			if _, err := msg.Generate(); err != nil {
+				t.Fatal(err)
+			}
+			if !useencoding && bytes.Contains(msg.Data[:len(msg.Data)-len(msg.EndingDelimiter())], msg.EndingDelimiter()) {
+				t.Errorf("(%q, encoding: %v) Expected escaped data not to contain the ending delimiter", delimiter, useencoding)
+			}
+
+			newmsg := conf.NewMessage()
+			newmsg.Data = msg.Data
+			if _, err := newmsg.Parse(); err != nil {
+				t.Fatalf("(%q, encoding: %v) %v", delimiter, useencoding, err)
+			}
+			if len(newmsg.Headers[key]) != 2 || newmsg.Headers[key][0] != value || newmsg.Headers[key][1] != "value2" {
+				t.Errorf("(%q, encoding: %v) Expected header %q to be [%q value2], got %q", delimiter, useencoding, key, value, newmsg.Headers[key])
+			}
+			if _, ok := newmsg.Headers[quickproto.ESCAPE_MARKER]; ok {
+				t.Errorf("(%q, encoding: %v) Expected escape marker not to be a header", delimiter, useencoding)
+			}
+			if newmsg.Files[fname] == nil {
+				t.Fatalf("(%q, encoding: %v) Expected file %q to exist", delimiter, useencoding, fname)
+			}
+			if !bytes.Equal(newmsg.Files[fname].Data, fdata) {
+				t.Errorf("(%q, encoding: %v) Expected file data %q, got %q", delimiter, useencoding, fdata, newmsg.Files[fname].Data)
+			}
+			if !bytes.Equal(newmsg.Body, body) {
+				t.Errorf("(%q, encoding: %v) Expected body %q, got %q", delimiter, useencoding, body, newmsg.Body)
+			}
+		}
+	}
+}
+
+func TestEscapeEmptyBody(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Escape = true
+	msg.AddHeader("key1", "value1")
+	msg.Generate()
+	msg.Parse()
+	if len(msg.Body) != 0 {
+		t.Errorf("Expected body to be empty, got %q", msg.Body)
+	}
+
+	msg = quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Escape = true
+	msg.AddHeader("key1", "value1")
+	msg.Body = []byte{0x00}
+	msg.Generate()
+	newmsg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	newmsg.Data = msg.Data
+	newmsg.Parse()
+	if !bytes.Equal(newmsg.Body, []byte{0x00}) {
+		t.Errorf("Expected body to be a NULL byte, got %q", newmsg.Body)
+	}
+}
+
+func TestEscapeEmptyHeader(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("$"), false, false, 2048, nil, nil)
+	conf.Escape = true
+	msg := conf.NewMessage()
+	msg.AddHeader("empty", "")
+	msg.AddHeader("empty", "\x00")
+	msg.AddHeader("empty", "")
+	msg.AddHeader("", "nokey")
+	msg.Body = []byte("x")
+	if _, err := msg.Generate(); err != nil {
+		t.Fatal(err)
+	}
+
+	newmsg := conf.NewMessage()
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := quickproto.NewDecoder(bytes.NewReader(msg.Data), conf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]*quickproto.Message{"parse": newmsg, "decoder": decoded} {
+		var values = m.Headers.Values("empty")
+		if len(values) != 3 || values[0] != "" || values[1] != "\x00" || values[2] != "" {
+			t.Errorf("(%s) Expected empty values to round trip, got %q", name, values)
+		}
+		if m.Headers.Get("") != "nokey" {
+			t.Errorf("(%s) Expected an empty key to round trip, got %v", name, m.Headers)
+		}
+		if string(m.Body) != "x" {
+			t.Errorf("(%s) Expected body x, got %q", name, m.Body)
+		}
+	}
+}
+
+func TestEscapeVersion(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("$"), false, false, 2048, nil, nil)
+	for _, data := range []string{"=V$2$$key$value$$$$x$$$$$$$$", "=V$1$2$$key$value$$$$x$$$$$$$$"} {
+		msg := conf.NewMessage()
+		msg.Data = []byte(data)
+		if _, err := msg.Parse(); err == nil {
+			t.Errorf("(%q) Expected Parse to reject an unknown escape version", data)
+		}
+		if _, err := quickproto.NewDecoder(bytes.NewReader([]byte(data)), conf).Decode(); err == nil {
+			t.Errorf("(%q) Expected the decoder to reject an unknown escape version", data)
+		}
+	}
+}
+
+func TestEscapeInvalidDelimiter(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("="), false, nil, nil)
+	msg.Escape = true
+	msg.AddHeader("key1", "value1")
+	if _, err := msg.Generate(); err == nil {
+		t.Error("Expected an error when escaping with the escape byte as delimiter")
+	}
+}
+
+func TestAddHeaderDelimiter(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	if err := msg.AddHeader("key1", "value&1"); err == nil {
+		t.Error("Expected an error when adding a header value containing the delimiter without escaping")
+	}
+}
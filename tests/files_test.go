@@ -1,7 +1,14 @@
 package tests
 
 import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Nigel2392/quickproto"
 )
@@ -58,3 +65,300 @@ func TestMessageFiles(t *testing.T) {
 		t.Error("Expected key2 to be value2")
 	}
 }
+
+func TestMessageFileMetadata(t *testing.T) {
+	var mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, escape := range []bool{false, true} {
+		for _, delim := range []string{"&", "###"} {
+			msg := quickproto.NewMessage([]byte(delim), false, nil, nil)
+			msg.Escape = escape
+			file := quickproto.NewMessageFile("image.png", []byte("\x89PNG&&&&&&&&DATA"))
+			file.Mode = 0600
+			file.ModTime = mtime
+			msg.AddFile(file)
+			msg.AddFile(quickproto.NewMessageFile("notes", []byte("Plain text notes")))
+			msg.AddFile(quickproto.NewMessageFileReader("stream.bin", strings.NewReader("STREAM")))
+			msg.Generate()
+
+			newmsg := quickproto.NewMessage([]byte(delim), false, nil, nil)
+			newmsg.Data = msg.Data
+			if _, err := newmsg.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			var image = newmsg.Files["image.png"]
+			if image == nil {
+				t.Fatalf("(%q, escape: %v) Expected image.png to be sent, got %v", delim, escape, newmsg.Files)
+			}
+			if image.MimeType != "image/png" {
+				t.Errorf("(%q, escape: %v) Expected image/png, got %q", delim, escape, image.MimeType)
+			}
+			if image.Mode != 0600 {
+				t.Errorf("(%q, escape: %v) Expected mode 0600, got %o", delim, escape, image.Mode)
+			}
+			if !image.ModTime.Equal(mtime) {
+				t.Errorf("(%q, escape: %v) Expected mtime %v, got %v", delim, escape, mtime, image.ModTime)
+			}
+			if !strings.HasPrefix(image.Checksum, "crc32:") {
+				t.Errorf("(%q, escape: %v) Expected a crc32 checksum, got %q", delim, escape, image.Checksum)
+			}
+			if !strings.HasPrefix(newmsg.Files["notes"].MimeType, "text/plain") {
+				t.Errorf("(%q, escape: %v) Expected notes to be detected as text/plain, got %q", delim, escape, newmsg.Files["notes"].MimeType)
+			}
+			if stream := newmsg.Files["stream.bin"]; stream == nil || string(stream.Data) != "STREAM" || stream.Checksum != "" {
+				t.Errorf("(%q, escape: %v) Expected stream.bin without checksum, got %v", delim, escape, stream)
+			}
+		}
+	}
+}
+
+func TestMessageFileLegacyName(t *testing.T) {
+	// Files sent without metadata.
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Data = []byte("key1&value1&&&&file1.txt&&false&&FILE1&&&&&&BODY")
+	if _, err := msg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	var file = msg.Files["file1.txt"]
+	if file == nil || string(file.Data) != "FILE1" {
+		t.Fatalf("Expected file1.txt to be FILE1, got %v", msg.Files)
+	}
+	if !strings.HasPrefix(file.MimeType, "text/plain") || file.Checksum != "" {
+		t.Errorf("Expected text/plain without checksum, got %q %q", file.MimeType, file.Checksum)
+	}
+}
+
+func TestMessageFileSave(t *testing.T) {
+	var dir = t.TempDir()
+	var mtime = time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := quickproto.NewMessageFile("file1", []byte("FILE1"))
+	file.Mode = 0600
+	file.ModTime = mtime
+	if err := file.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "file1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("Expected mtime %v, got %v", mtime, info.ModTime())
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "file1"))
+	if !bytes.Equal(data, []byte("FILE1")) {
+		t.Errorf("Expected FILE1, got %q", data)
+	}
+}
+
+func TestAddFileFromPath(t *testing.T) {
+	var dir = t.TempDir()
+	var files = map[string][]byte{
+		"plain.txt":   []byte(strings.Repeat("PLAIN TEXT ", 10000)),
+		"encoded.bin": []byte(strings.Repeat("BINARY&&&&&&&&DATA", 10000)),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, escape := range []bool{false, true} {
+		msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+		msg.Escape = escape
+		for name := range files {
+			if err := msg.AddFileFromPath(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg.Files["encoded.bin"].Size() != len(files["encoded.bin"]) {
+			t.Errorf("Expected size %d, got %d", len(files["encoded.bin"]), msg.Files["encoded.bin"].Size())
+		}
+		if _, err := msg.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		// Files without delimiters are sent as is.
+		if !escape && !bytes.Contains(msg.Data, files["plain.txt"]) {
+			t.Error("Expected plain.txt not to be encoded")
+		}
+		newmsg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+		newmsg.Data = msg.Data
+		if _, err := newmsg.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range files {
+			file := newmsg.Files[name]
+			if file == nil || !bytes.Equal(file.Data, data) {
+				t.Errorf("(escape: %v) Expected %s to round trip", escape, name)
+				continue
+			}
+			if file.Mode.Perm() != 0600 {
+				t.Errorf("(escape: %v) Expected mode of %s to be 0600, got %o", escape, name, file.Mode)
+			}
+			if file.Checksum != msg.Files[name].Checksum || file.Checksum == "" {
+				t.Errorf("(escape: %v) Expected checksum of %s to be sent, got %q", escape, name, file.Checksum)
+			}
+		}
+	}
+	if err := quickproto.NewMessage(nil, false, nil, nil).AddFileFromPath(dir); err == nil {
+		t.Error("Expected an error when adding a directory")
+	}
+}
+
+func TestAddFileReader(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.AddFileReader("file1", strings.NewReader("FILE1FILE1"), 5)
+	msg.Generate()
+	newmsg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if string(newmsg.Files["file1"].Data) != "FILE1" {
+		t.Errorf("Expected file1 to be FILE1, got %q", newmsg.Files["file1"].Data)
+	}
+
+	msg = quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.AddFileReader("file1", strings.NewReader("FILE1"), 10)
+	if _, err := msg.Generate(); err == nil {
+		t.Error("Expected an error when the reader is shorter than its size")
+	}
+}
+
+func TestSpillFiles(t *testing.T) {
+	var spilldir = t.TempDir()
+	var large = []byte(strings.Repeat("LARGE&&&&&&&&FILE", 1000))
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	conf.SpillThreshold = 1024
+	conf.SpillDir = spilldir
+	msg := conf.NewMessage()
+	msg.AddRawFile("small", []byte("SMALL"))
+	msg.AddRawFile("large", large)
+	msg.Generate()
+
+	var decoded, err = quickproto.NewDecoder(bytes.NewReader(msg.Data), conf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newmsg := conf.NewMessage()
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]*quickproto.Message{"parse": newmsg, "decoder": decoded} {
+		if string(m.Files["small"].Data) != "SMALL" || m.Files["small"].Path != "" {
+			t.Errorf("(%s) Expected small to be kept in memory", name)
+		}
+		var file = m.Files["large"]
+		if file.Data != nil || !strings.HasPrefix(file.Path, spilldir) {
+			t.Fatalf("(%s) Expected large to be spilled to %s, got %q", name, spilldir, file.Path)
+		}
+		if file.Size() != len(large) {
+			t.Errorf("(%s) Expected size %d, got %d", name, len(large), file.Size())
+		}
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(r)
+		r.Close()
+		if !bytes.Equal(buf.Bytes(), large) {
+			t.Errorf("(%s) Expected spilled data to round trip", name)
+		}
+	}
+
+	// Unmarshal reads spilled files from disk.
+	var v struct {
+		Large []byte `qp:"large,file"`
+	}
+	if err := quickproto.Unmarshal(decoded, &v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v.Large, large) {
+		t.Errorf("Expected the spilled file to be unmarshalled, got %d bytes", len(v.Large))
+	}
+
+	// Save moves the temporary file.
+	var savedir = t.TempDir()
+	var tmp = newmsg.Files["large"].Path
+	if err := newmsg.Files["large"].Save(savedir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("Expected the temporary file to be moved")
+	}
+	if data, _ := os.ReadFile(filepath.Join(savedir, "large")); !bytes.Equal(data, large) {
+		t.Error("Expected saved data to be equal to the file")
+	}
+	// Close removes the remaining temporary files.
+	if err := decoded.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(spilldir); len(entries) != 0 {
+		t.Errorf("Expected Close to remove all temporary files, found %d", len(entries))
+	}
+}
+
+func TestSpillFilesInvalidBody(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	conf.Escape = true
+	conf.SpillThreshold = 8
+	conf.SpillDir = t.TempDir()
+	msg := conf.NewMessage()
+	msg.AddRawFile("large", []byte(strings.Repeat("LARGE&", 20)))
+	msg.Body = []byte("B&DY")
+	msg.Generate()
+
+	newmsg := conf.NewMessage()
+	newmsg.Data = bytes.Replace(msg.Data, []byte("B=CGDY"), []byte("B=ZZDY"), 1)
+	if _, err := newmsg.Parse(); err == nil {
+		t.Fatal("Expected an error for an invalid escape sequence in the body")
+	}
+	if entries, _ := os.ReadDir(conf.SpillDir); len(entries) != 0 {
+		t.Errorf("Expected the spilled files to be removed, found %d", len(entries))
+	}
+}
+
+func TestReadConnSpill(t *testing.T) {
+	var large = []byte(strings.Repeat("LARGE&&&&&&&&FILE", 1000))
+	for _, framing := range []quickproto.Framing{quickproto.FramingDelimiter, quickproto.FramingLength} {
+		conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+		conf.Framing = framing
+		conf.SpillThreshold = 1024
+		conf.SpillDir = t.TempDir()
+		server, client := net.Pipe()
+		go func() {
+			for i := 0; i < 2; i++ {
+				msg := conf.NewMessage()
+				msg.AddHeader("index", strconv.Itoa(i))
+				msg.AddRawFile("large", large)
+				msg.Body = []byte("BODY")
+				if err := quickproto.WriteConn(client, msg, nil, false); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		var r = quickproto.NewReader(server, conf)
+		for i := 0; i < 2; i++ {
+			msg, err := quickproto.ReadConn(r, conf, nil, false)
+			if err != nil {
+				t.Fatalf("(framing: %v) message %d: %v", framing, i, err)
+			}
+			if msg.Headers.Get("index") != strconv.Itoa(i) || string(msg.Body) != "BODY" {
+				t.Errorf("(framing: %v) message %d: unexpected message %v", framing, i, msg)
+			}
+			if len(msg.Data) != 0 {
+				t.Errorf("(framing: %v) message %d: expected the message not to be held in memory", framing, i)
+			}
+			var file = msg.Files["large"]
+			if file.Data != nil || !strings.HasPrefix(file.Path, conf.SpillDir) {
+				t.Errorf("(framing: %v) message %d: expected large to be spilled, got %q", framing, i, file.Path)
+			}
+			msg.Close()
+		}
+		server.Close()
+		client.Close()
+	}
+}
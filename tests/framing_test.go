@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/simplecrypto/aes"
+)
+
+func randomBody(r *rand.Rand, size int, exclude byte) []byte {
+	body := make([]byte, size)
+	r.Read(body)
+	for i, b := range body {
+		if b == exclude || b == 0x00 {
+			body[i] = 'x'
+		}
+	}
+	return body
+}
+
+func TestLengthFraming(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	conf.Framing = quickproto.FramingLength
+	var key = aes.NewEncryptionKey()
+	var r = rand.New(rand.NewSource(1))
+	for _, compress := range []bool{false, true} {
+		for _, aes_key := range []*[32]byte{nil, key} {
+			server, client := net.Pipe()
+			var bodies [][]byte
+			for i := 0; i < 25; i++ {
+				bodies = append(bodies, randomBody(r, 64+r.Intn(4096), '&'))
+			}
+			go func() {
+				for _, body := range bodies {
+					msg := conf.NewMessage()
+					msg.AddHeader("key1", "value1")
+					msg.Body = body
+					if err := quickproto.WriteConn(client, msg, aes_key, compress); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			for i, body := range bodies {
+				msg, err := quickproto.ReadConn(server, conf, aes_key, compress)
+				if err != nil {
+					t.Fatalf("(compress: %v, crypto: %v) message %d: %v", compress, aes_key != nil, i, err)
+				}
+				if msg.Headers["key1"][0] != "value1" {
+					t.Errorf("(compress: %v, crypto: %v) message %d: expected key1 to be value1", compress, aes_key != nil, i)
+				}
+				if !bytes.Equal(msg.Body, body) {
+					t.Errorf("(compress: %v, crypto: %v) message %d: body mismatch", compress, aes_key != nil, i)
+				}
+			}
+			server.Close()
+			client.Close()
+		}
+	}
+}
+
+// Collects everything written to the connection, to send it in one write.
+type collectConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *collectConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func TestLengthFramingTCP(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	conf.Framing = quickproto.FramingLength
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var bodies = [][]byte{[]byte("first body"), []byte("second body")}
+	go func() {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer client.Close()
+		// Write both messages in a single call, so they arrive in the same segment.
+		var buf = &collectConn{Conn: client}
+		for _, body := range bodies {
+			msg := conf.NewMessage()
+			msg.AddHeader("key1", "value1")
+			msg.Body = body
+			if err := quickproto.WriteConn(buf, msg, nil, false); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		client.Write(buf.buf.Bytes())
+	}()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for i, body := range bodies {
+		msg, err := quickproto.ReadConn(server, conf, nil, false)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(msg.Body, body) {
+			t.Errorf("message %d: expected body %q, got %q", i, body, msg.Body)
+		}
+	}
+}
+
+func TestLengthFramingMaxSize(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+	conf.Framing = quickproto.FramingLength
+	conf.MaxFrameSize = 128
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		msg := conf.NewMessage()
+		msg.AddHeader("key1", "value1")
+		msg.Body = bytes.Repeat([]byte("BODY"), 64)
+		quickproto.WriteConn(client, msg, nil, false)
+	}()
+	if _, err := quickproto.ReadConn(server, conf, nil, false); err == nil {
+		t.Error("Expected frame larger than MaxFrameSize to be rejected")
+	}
+}
+
+func TestLengthFramingHostileHeader(t *testing.T) {
+	for _, maxsize := range []int64{0, -1} {
+		conf := quickproto.NewConfig([]byte("&"), false, false, 2048, nil, nil)
+		conf.Framing = quickproto.FramingLength
+		conf.MaxFrameSize = maxsize
+		for _, length := range []uint64{1 << 62, 1<<63 + 1, 1 << 40} {
+			var header = []byte{'Q', 0, 0, 0, 0, 0, 0, 0, 0, 0}
+			binary.BigEndian.PutUint64(header[2:], length)
+			if _, err := quickproto.ReadConn(bytes.NewReader(header), conf, nil, false); err == nil {
+				t.Errorf("(max: %d) Expected an error for a frame of %d bytes", maxsize, length)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"bytes"
 	"encoding/base64"
 	"strings"
 	"testing"
@@ -249,3 +250,44 @@ func TestEmptyBody(t *testing.T) {
 		t.Error("Expected body to be empty")
 	}
 }
+
+func TestParseOwnedCopy(t *testing.T) {
+	for _, owned := range []bool{false, true} {
+		msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+		msg.AddHeader("key1", "value1")
+		msg.AddRawFile("file1", []byte("FILE1"))
+		msg.Body = []byte("BODYBODYBODY")
+		msg.Generate()
+
+		newmsg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+		newmsg.OwnedCopy = owned
+		newmsg.Data = msg.Data
+		if _, err := newmsg.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		// Overwrite the received data, only owned copies should keep their content.
+		for i := range newmsg.Data {
+			newmsg.Data[i] = 'X'
+		}
+		if owned != bytes.Equal(newmsg.Body, []byte("BODYBODYBODY")) {
+			t.Errorf("(owned: %v) Unexpected body %q", owned, newmsg.Body)
+		}
+		if owned != bytes.Equal(newmsg.Files["file1"].Data, []byte("FILE1")) {
+			t.Errorf("(owned: %v) Unexpected file data %q", owned, newmsg.Files["file1"].Data)
+		}
+	}
+}
+
+func TestParseNoHeaders(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Data = []byte("&&BODYBODYBODY&&&&&&&&")
+	if _, err := msg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Headers) != 0 {
+		t.Errorf("Expected no headers, got %v", msg.Headers)
+	}
+	if string(msg.Body) != "BODYBODYBODY" {
+		t.Error("Expected body to be BODYBODYBODY, got " + string(msg.Body))
+	}
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func TestHeader(t *testing.T) {
+	var h = make(quickproto.Header)
+	h.Add("Key1", "value1")
+	h.Add("KEY1", "value2")
+	if h.Get("key1") != "value1" {
+		t.Errorf("Expected key1 to be value1, got %q", h.Get("key1"))
+	}
+	if len(h.Values("kEy1")) != 2 {
+		t.Errorf("Expected key1 to have 2 values, got %v", h.Values("kEy1"))
+	}
+	h.Set("key1", "value3")
+	if len(h.Values("key1")) != 1 || h.Get("key1") != "value3" {
+		t.Errorf("Expected key1 to be value3, got %v", h.Values("key1"))
+	}
+	var clone = h.Clone()
+	h.Del("Key1")
+	if h.Has("key1") {
+		t.Error("Expected key1 to be deleted")
+	}
+	if clone.Get("key1") != "value3" {
+		t.Error("Expected clone to keep key1")
+	}
+	if h.Get("missing") != "" {
+		t.Error("Expected missing header to be empty")
+	}
+}
+
+func TestHeaderTyped(t *testing.T) {
+	var now = time.Now().Truncate(time.Second)
+	var h = make(quickproto.Header)
+	h.Set("int", "42")
+	h.Set("bool", "true")
+	h.Set("duration", "1m30s")
+	h.Set("time", now.Format(time.RFC3339))
+	if i, err := h.GetInt("int"); err != nil || i != 42 {
+		t.Errorf("Expected int to be 42, got %d (%v)", i, err)
+	}
+	if b, err := h.GetBool("bool"); err != nil || !b {
+		t.Errorf("Expected bool to be true, got %v (%v)", b, err)
+	}
+	if d, err := h.GetDuration("duration"); err != nil || d != 90*time.Second {
+		t.Errorf("Expected duration to be 1m30s, got %v (%v)", d, err)
+	}
+	if tm, err := h.GetTime("time"); err != nil || !tm.Equal(now) {
+		t.Errorf("Expected time to be %v, got %v (%v)", now, tm, err)
+	}
+	if _, err := h.GetInt("missing"); err == nil {
+		t.Error("Expected an error for a missing header")
+	}
+	if _, err := h.GetInt("bool"); err == nil {
+		t.Error("Expected an error for an invalid int")
+	}
+}
+
+func TestHeaderParseCanonical(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.Data = []byte("Content-Type&text/plain&&&&BODY")
+	if _, err := msg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers.Get("CONTENT-TYPE") != "text/plain" {
+		t.Errorf("Expected content-type to be text/plain, got %v", msg.Headers)
+	}
+}
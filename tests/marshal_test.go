@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+type upperString string
+
+func (u upperString) MarshalQP() ([]byte, error) {
+	return []byte(strings.ToUpper(string(u))), nil
+}
+
+func (u *upperString) UnmarshalQP(data []byte) error {
+	*u = upperString(strings.ToLower(string(data)))
+	return nil
+}
+
+type marshalAddress struct {
+	Street string `qp:"street"`
+	Number int    `qp:"number"`
+}
+
+type marshalTest struct {
+	Name     string         `qp:"name"`
+	Tags     []string       `qp:"tags,header"`
+	Age      int            `qp:"age"`
+	Admin    bool           `qp:"admin"`
+	Score    float64        `qp:"score"`
+	Created  time.Time      `qp:"created"`
+	Timeout  time.Duration  `qp:"timeout"`
+	Token    []byte         `qp:"token"`
+	Custom   upperString    `qp:"custom"`
+	Address  marshalAddress `qp:"address"`
+	Previous *marshalAddress
+	Content  string `qp:"content,body"`
+	Image    []byte `qp:"image.png,file"`
+	Skipped  string `qp:"-"`
+	private  string
+}
+
+func TestMarshal(t *testing.T) {
+	var v = marshalTest{
+		Name:     "quickproto",
+		Tags:     []string{"fast", "simple"},
+		Age:      3,
+		Admin:    true,
+		Score:    1.5,
+		Created:  time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC),
+		Timeout:  time.Minute,
+		Token:    []byte{0x00, 0xFF, '&'},
+		Custom:   "custom",
+		Address:  marshalAddress{Street: "Main street", Number: 10},
+		Previous: &marshalAddress{Street: "Side street", Number: 20},
+		Content:  "BODYBODYBODY",
+		Image:    []byte("IMAGE&&&&&&&&DATA"),
+		Skipped:  "skipped",
+		private:  "private",
+	}
+	msg, err := quickproto.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers.Get("custom") != "CUSTOM" {
+		t.Errorf("Expected custom to be marshalled with MarshalQP, got %q", msg.Headers.Get("custom"))
+	}
+	if msg.Headers.Get("address.street") != "Main street" {
+		t.Errorf("Expected nested header address.street, got %v", msg.Headers)
+	}
+	if msg.Headers.Has("skipped") || msg.Headers.Has("private") {
+		t.Error("Expected skipped and private fields not to be marshalled")
+	}
+	if _, err := msg.Generate(); err != nil {
+		t.Fatal(err)
+	}
+
+	newmsg := quickproto.NewMessage(nil, false, nil, nil)
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	var newv marshalTest
+	if err := quickproto.Unmarshal(newmsg, &newv); err != nil {
+		t.Fatal(err)
+	}
+	if newv.Name != v.Name || newv.Age != v.Age || newv.Admin != v.Admin || newv.Score != v.Score || newv.Timeout != v.Timeout {
+		t.Errorf("Expected %+v, got %+v", v, newv)
+	}
+	if len(newv.Tags) != 2 || newv.Tags[0] != "fast" || newv.Tags[1] != "simple" {
+		t.Errorf("Expected tags to be [fast simple], got %v", newv.Tags)
+	}
+	if !newv.Created.Equal(v.Created) {
+		t.Errorf("Expected created to be %v, got %v", v.Created, newv.Created)
+	}
+	if !bytes.Equal(newv.Token, v.Token) {
+		t.Errorf("Expected token to be %v, got %v", v.Token, newv.Token)
+	}
+	if newv.Custom != "custom" {
+		t.Errorf("Expected custom to be unmarshalled with UnmarshalQP, got %q", newv.Custom)
+	}
+	if newv.Address != v.Address {
+		t.Errorf("Expected address to be %v, got %v", v.Address, newv.Address)
+	}
+	if newv.Previous == nil || *newv.Previous != *v.Previous {
+		t.Errorf("Expected previous to be %v, got %v", v.Previous, newv.Previous)
+	}
+	if newv.Content != v.Content {
+		t.Errorf("Expected content to be %q, got %q", v.Content, newv.Content)
+	}
+	if !bytes.Equal(newv.Image, v.Image) {
+		t.Errorf("Expected image to be %q, got %q", v.Image, newv.Image)
+	}
+	if newv.Skipped != "" {
+		t.Error("Expected skipped to be empty")
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	if _, err := quickproto.Marshal("string"); err == nil {
+		t.Error("Expected an error when marshalling a string")
+	}
+	var v struct {
+		Channel chan int
+	}
+	if _, err := quickproto.Marshal(&v); err == nil {
+		t.Error("Expected an error when marshalling a channel")
+	}
+	if err := quickproto.Unmarshal(quickproto.NewMessage(nil, false, nil, nil), v); err == nil {
+		t.Error("Expected an error when unmarshalling into a non-pointer")
+	}
+}
+
+type codecPayload struct {
+	Text  string
+	Count int
+}
+
+func TestMarshalBodyCodec(t *testing.T) {
+	var v struct {
+		Kind    string       `qp:"kind"`
+		Payload codecPayload `qp:"payload,body"`
+	}
+	v.Kind = "payload"
+	v.Payload = codecPayload{Text: "hello", Count: 2}
+	msg, err := quickproto.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers.Get("content-type") != "application/json" {
+		t.Errorf("Expected content-type to be application/json, got %q", msg.Headers.Get("content-type"))
+	}
+	msg.Generate()
+	newmsg := quickproto.NewMessage(nil, false, nil, nil)
+	newmsg.Data = msg.Data
+	if _, err := newmsg.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	var newv = v
+	newv.Payload = codecPayload{}
+	if err := quickproto.Unmarshal(newmsg, &newv); err != nil {
+		t.Fatal(err)
+	}
+	if newv.Payload != v.Payload {
+		t.Errorf("Expected payload to be %v, got %v", v.Payload, newv.Payload)
+	}
+}
@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func TestMessageFS(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	msg.AddRawFile("index.tmpl", []byte("Hello {{.}}"))
+	msg.AddRawFile("static/css/style.css", []byte("body {}"))
+	msg.AddRawFile("static/app.js", []byte("console.log('&&&&&&&&')"))
+	msg.AddRawFile("../invalid", []byte("INVALID"))
+	newmsg := sendMessage(t, msg)
+
+	var fsys = newmsg.FS()
+	if err := fstest.TestFS(fsys, "index.tmpl", "static/css/style.css", "static/app.js"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "../invalid"); err == nil {
+		t.Error("Expected invalid paths to be left out")
+	}
+	matches, err := fs.Glob(fsys, "static/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(matches, ",") != "static/app.js,static/css" {
+		t.Errorf("Expected static/app.js and static/css, got %v", matches)
+	}
+	tmpl, err := template.ParseFS(fsys, "*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	tmpl.Execute(&out, "World")
+	if out.String() != "Hello World" {
+		t.Errorf("Expected Hello World, got %q", out.String())
+	}
+}
+
+func TestMessageFSDirEntries(t *testing.T) {
+	msg := quickproto.NewMessage([]byte("&"), false, nil, nil)
+	if err := msg.AddFS(fstest.MapFS{
+		"dir/empty": {Mode: fs.ModeDir | 0700},
+		"dir/file":  {Data: []byte("FILE"), Mode: 0600},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fsys := sendMessage(t, msg).FS()
+	if err := fstest.TestFS(fsys, "dir/empty", "dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(fsys, "dir/empty")
+	if err != nil || info.Mode() != fs.ModeDir|0700 {
+		t.Errorf("Expected dir/empty to keep its mode, got %v (%v)", info, err)
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+// Middleware which appends its name to the order.
+func orderMiddleware(order *[]string, name string) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return server.HandlerFunc(func(w server.ResponseWriter, req *quickproto.Message) {
+			*order = append(*order, name)
+			next.ServeQP(w, req)
+		})
+	}
+}
+
+func serveTest(h server.Handler, req *quickproto.Message, client *server.Client) *responseRecorder {
+	var w = newRecorder(req)
+	w.client = client
+	h.ServeQP(w, req)
+	return w
+}
+
+func newRouteMessage(path string) *quickproto.Message {
+	var req = quickproto.NewMessage(nil, false, nil, nil)
+	req.Headers.Set("path", path)
+	return req
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	mux := server.NewServeMux("path")
+	mux.Use(orderMiddleware(&order, "mux"))
+	admin := mux.Group("admin/", orderMiddleware(&order, "admin"))
+	admin.HandleFunc("users", func(w server.ResponseWriter, req *quickproto.Message) {
+		order = append(order, "handler")
+	})
+	// Added after the route was registered.
+	admin.Use(orderMiddleware(&order, "admin2"))
+	nested := admin.Group("settings/", orderMiddleware(&order, "settings"))
+	nested.HandleFunc("*", func(w server.ResponseWriter, req *quickproto.Message) {
+		order = append(order, "settings handler")
+	})
+
+	serveTest(mux, newRouteMessage("admin/users"), nil)
+	if got := strings.Join(order, ","); got != "mux,admin,admin2,handler" {
+		t.Errorf("Expected mux,admin,admin2,handler, got %s", got)
+	}
+	order = nil
+	serveTest(mux, newRouteMessage("admin/settings/theme"), nil)
+	if got := strings.Join(order, ","); got != "mux,admin,admin2,settings,settings handler" {
+		t.Errorf("Expected mux,admin,admin2,settings,settings handler, got %s", got)
+	}
+	order = nil
+	var w = serveTest(mux, newRouteMessage("users"), nil)
+	if got := strings.Join(order, ","); got != "mux" || w.messages[0].Headers.Get(server.STATUS_HEADER) != "404" {
+		t.Errorf("Expected only the mux middleware before NotFound, got %s", got)
+	}
+
+	order = nil
+	serveTest(server.Chain(routeHandler("chain"), orderMiddleware(&order, "1"), orderMiddleware(&order, "2")), newRouteMessage(""), nil)
+	if got := strings.Join(order, ","); got != "1,2" {
+		t.Errorf("Expected 1,2, got %s", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	var logger = log.New(&logs, "", 0)
+	var panics = server.Chain(server.HandlerFunc(func(w server.ResponseWriter, req *quickproto.Message) {
+		panic("handler panic")
+	}), server.Logging(logger), server.Recover(logger))
+	var w = serveTest(panics, newRouteMessage(""), nil)
+	if len(w.messages) != 1 || w.messages[0].Headers.Get(server.STATUS_HEADER) != "500" {
+		t.Errorf("Expected an internal error, got %v", w.messages)
+	}
+	if !strings.Contains(logs.String(), "handler panic") || !strings.Contains(logs.String(), " 500 ") {
+		t.Errorf("Expected the panic and the status to be logged, got %q", logs.String())
+	}
+
+	var required = server.RequireHeaders("key1", "key2")(routeHandler("required"))
+	var req = newRouteMessage("")
+	req.Headers.Set("key1", "value1")
+	if w = serveTest(required, req, nil); w.messages[0].Headers.Get(server.ERROR_HEADER) != "missing header key2" {
+		t.Errorf("Expected a missing header error, got %v", w.messages[0].Headers)
+	}
+	req.Headers.Set("key2", "value2")
+	if w = serveTest(required, req, nil); string(w.messages[0].Body) != "required" {
+		t.Errorf("Expected the handler to run, got %q", w.messages[0].Body)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	var calls int
+	var auth = server.Auth("session", func(client *server.Client, value string) (any, error) {
+		calls++
+		if value != "secret" {
+			return nil, errors.New("invalid session")
+		}
+		return "user1", nil
+	})(routeHandler("authenticated"))
+
+	var client = &server.Client{Cookies: make(quickproto.Header)}
+	if w := serveTest(auth, newRouteMessage(""), client); w.messages[0].Headers.Get(server.STATUS_HEADER) != "401" {
+		t.Errorf("Expected an unauthorized error without a cookie, got %v", w.messages[0].Headers)
+	}
+	client.Cookies.Set("session", "wrong")
+	if w := serveTest(auth, newRouteMessage(""), client); w.messages[0].Headers.Get(server.STATUS_HEADER) != "401" || client.Data != nil {
+		t.Errorf("Expected an unauthorized error with a wrong cookie, got %v", w.messages[0].Headers)
+	}
+	client.Cookies.Set("session", "secret")
+	for i := 0; i < 2; i++ {
+		if w := serveTest(auth, newRouteMessage(""), client); string(w.messages[0].Body) != "authenticated" {
+			t.Errorf("Expected the handler to run, got %v", w.messages[0].Headers)
+		}
+	}
+	if client.Data != "user1" || calls != 2 {
+		t.Errorf("Expected the client to be authenticated once, got %v after %d calls", client.Data, calls)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	var late = make(chan error, 1)
+	var timeout = server.Timeout(20 * time.Millisecond)(server.HandlerFunc(func(w server.ResponseWriter, req *quickproto.Message) {
+		if req.Headers.Get("path") == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		late <- w.Write(w.NewMessage())
+	}))
+	var w = serveTest(timeout, newRouteMessage("slow"), nil)
+	w.mu.Lock()
+	if len(w.messages) != 1 || w.messages[0].Headers.Get(server.STATUS_HEADER) != "504" {
+		t.Errorf("Expected a timeout error, got %v", w.messages)
+	}
+	w.mu.Unlock()
+	if err := <-late; !errors.Is(err, server.ErrHandlerTimeout) {
+		t.Errorf("Expected writes after the timeout to fail, got %v", err)
+	}
+	if w = serveTest(timeout, newRouteMessage("fast"), nil); len(w.messages) != 1 || w.messages[0].Headers.Has(server.STATUS_HEADER) {
+		t.Errorf("Expected the response of the handler, got %v", w.messages)
+	}
+	<-late
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+// Records the messages written by a handler.
+type responseRecorder struct {
+	conf     *quickproto.Config
+	req      *quickproto.Message
+	client   *server.Client
+	mu       sync.Mutex
+	messages []*quickproto.Message
+}
+
+func newRecorder(req *quickproto.Message) *responseRecorder {
+	return &responseRecorder{conf: quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil), req: req}
+}
+
+func (r *responseRecorder) NewMessage() *quickproto.Message {
+	var msg = r.conf.NewMessage()
+	msg.ReplyTo(r.req)
+	return msg
+}
+
+func (r *responseRecorder) Write(msg *quickproto.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+func (r *responseRecorder) Client() *server.Client { return r.client }
+func (r *responseRecorder) Server() *server.Server { return nil }
+
+func routeHandler(route string) server.HandlerFunc {
+	return func(w server.ResponseWriter, req *quickproto.Message) {
+		var msg = w.NewMessage()
+		msg.Body = []byte(route)
+		w.Write(msg)
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	mux := server.NewServeMux("type")
+	mux.Handle("users", routeHandler("users"))
+	mux.Handle("users/*", routeHandler("users/*"))
+	mux.Handle("users/admin/*", routeHandler("users/admin/*"))
+	mux.Handle("chat.*.message", routeHandler("chat.*.message"))
+	mux.Handle("chat.[ab]?", routeHandler("chat.[ab]?"))
+
+	var routes = map[string]string{
+		"users":               "users",
+		"users/1":             "users/*",
+		"users/1/posts":       "users/*",
+		"users/admin/1":       "users/admin/*",
+		"chat.room.message":   "chat.*.message",
+		"chat.a1":             "chat.[ab]?",
+		"chat.c1":             "",
+		"unknown":             "",
+		"chat.room/x.message": "",
+	}
+	for value, route := range routes {
+		var req = quickproto.NewMessage(nil, false, nil, nil)
+		req.Headers.Set("Type", value)
+		var w = newRecorder(req)
+		mux.ServeQP(w, req)
+		if len(w.messages) != 1 {
+			t.Fatalf("(%s) Expected one response, got %d", value, len(w.messages))
+		}
+		var resp = w.messages[0]
+		if route == "" {
+			if resp.Headers.Get(server.STATUS_HEADER) != "404" || resp.Headers.Get(server.ERROR_HEADER) != "not found" {
+				t.Errorf("(%s) Expected a not found error, got %v", value, resp.Headers)
+			}
+			continue
+		}
+		if string(resp.Body) != route {
+			t.Errorf("(%s) Expected route %s, got %s", value, route, resp.Body)
+		}
+	}
+
+	mux.NotFound = routeHandler("custom")
+	var req = quickproto.NewMessage(nil, false, nil, nil)
+	var w = newRecorder(req)
+	mux.ServeQP(w, req)
+	if string(w.messages[0].Body) != "custom" {
+		t.Errorf("Expected the custom NotFound handler, got %q", w.messages[0].Body)
+	}
+
+	for _, pattern := range []string{"users", "users/*", "chat.[", "nil"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Handle(%q) to panic", pattern)
+				}
+			}()
+			if pattern == "nil" {
+				mux.Handle(pattern, nil)
+			} else {
+				mux.Handle(pattern, routeHandler(pattern))
+			}
+		}()
+	}
+}
+
+func TestServeClient(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	s, sc, c := connectTestClient(t, conf)
+	mux := server.NewServeMux("")
+	mux.HandleFunc("echo", func(w server.ResponseWriter, req *quickproto.Message) {
+		var msg = w.NewMessage()
+		msg.Body = req.Body
+		w.Write(msg)
+	})
+	go s.ServeClient(sc, mux)
+
+	var req = conf.NewMessage()
+	req.AddHeader("path", "echo")
+	req.Body = []byte("ECHO")
+	resp, err := c.Request(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "ECHO" {
+		t.Errorf("Expected ECHO, got %q", resp.Body)
+	}
+	req = conf.NewMessage()
+	req.AddHeader("path", "missing")
+	if resp, err = c.Request(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Headers.Get(server.STATUS_HEADER) != "404" {
+		t.Errorf("Expected a not found error, got %v", resp.Headers)
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/client"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+// Start a server on a random port, and connect a client to it.
+func connectTestClient(t *testing.T, conf *quickproto.Config) (*server.Server, *server.Client, *client.Client) {
+	s := server.New("127.0.0.1", 0, conf)
+	if _, err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Terminate() })
+	var accepted = make(chan *server.Client, 1)
+	go func() {
+		_, c, err := s.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	c := client.New("127.0.0.1", s.Listener.Addr().(*net.TCPAddr).Port, conf, nil)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Terminate() })
+	return s, <-accepted, c
+}
+
+func pipelineConfigs() map[string]*quickproto.Config {
+	plain := quickproto.NewConfig([]byte("&"), false, false, 64, nil, nil)
+	encoded := quickproto.NewConfig([]byte("&"), true, false, 64, quickproto.Base64Encoding, quickproto.Base64Decoding)
+	crypto := quickproto.NewConfig([]byte("&"), false, true, 64, nil, nil)
+	crypto.Compressed = true
+	crypto.Framing = quickproto.FramingLength
+	return map[string]*quickproto.Config{"plain": plain, "encoded": encoded, "crypto": crypto}
+}
+
+func TestPipelinedWrites(t *testing.T) {
+	for name, conf := range pipelineConfigs() {
+		s, sc, c := connectTestClient(t, conf)
+		const count = 20
+		// Write all messages before reading any of them.
+		for i := 0; i < count; i++ {
+			msg := conf.NewMessage()
+			msg.AddHeader("index", strconv.Itoa(i))
+			msg.AddContent("Message " + strconv.Itoa(i))
+			if err := c.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < count; i++ {
+			msg, err := s.Read(sc)
+			if err != nil {
+				t.Fatalf("(%s) message %d: %v", name, i, err)
+			}
+			if msg.Headers["index"][0] != strconv.Itoa(i) {
+				t.Errorf("(%s) Expected message %d, got %s", name, i, msg.Headers["index"][0])
+			}
+			if string(msg.Body) != "Message "+strconv.Itoa(i) {
+				t.Errorf("(%s) Expected body \"Message %d\", got %q", name, i, msg.Body)
+			}
+		}
+	}
+}
+
+func TestPipelinedBroadcast(t *testing.T) {
+	for name, conf := range pipelineConfigs() {
+		s, _, c := connectTestClient(t, conf)
+		const count = 20
+		for i := 0; i < count; i++ {
+			msg := conf.NewMessage()
+			msg.AddHeader("index", strconv.Itoa(i))
+			if err := s.Broadcast(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < count; i++ {
+			msg, err := c.Read()
+			if err != nil {
+				t.Fatalf("(%s) message %d: %v", name, i, err)
+			}
+			if msg.Headers["index"][0] != strconv.Itoa(i) {
+				t.Errorf("(%s) Expected message %d, got %s", name, i, msg.Headers["index"][0])
+			}
+		}
+	}
+}
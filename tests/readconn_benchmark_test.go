@@ -0,0 +1,87 @@
+// go test -benchmem -run=^# -v -bench=ReadConn github.com/Nigel2392/quickproto/tests
+
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func getReadConnData(size int) (*quickproto.Config, []byte) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	msg := conf.NewMessage()
+	msg.AddHeader("key1", "value1")
+	msg.Body = []byte(strings.Repeat("BODYBODYBODY_", size/13))
+	msg.Generate()
+	return conf, msg.Data
+}
+
+// The previous implementation of ReadConn, which searches all data for the ending delimiter after every read.
+func naiveReadConn(conn io.Reader, conf *quickproto.Config) (*quickproto.Message, error) {
+	msg := conf.NewMessage()
+	buf := make([]byte, conf.BufSize)
+	var data []byte
+	for !bytes.Contains(data, msg.EndingDelimiter()) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, buf[:n]...)
+	}
+	msg.Data = data
+	return msg.Parse()
+}
+
+func benchmarkReadConn(b *testing.B, size int, naive bool) {
+	conf, data := getReadConnData(size)
+	var reader = bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(data)
+		var err error
+		if naive {
+			_, err = naiveReadConn(reader, conf)
+		} else {
+			_, err = quickproto.ReadConn(reader, conf, nil, false)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadConnNaive1MB(b *testing.B) { benchmarkReadConn(b, 1<<20, true) }
+func BenchmarkReadConnNaive4MB(b *testing.B) { benchmarkReadConn(b, 4<<20, true) }
+func BenchmarkReadConn1MB(b *testing.B)      { benchmarkReadConn(b, 1<<20, false) }
+func BenchmarkReadConn4MB(b *testing.B)      { benchmarkReadConn(b, 4<<20, false) }
+func BenchmarkReadConn16MB(b *testing.B)     { benchmarkReadConn(b, 16<<20, false) }
+
+func TestReadConnSplitDelimiter(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("###"), false, false, 16, nil, nil)
+	msg := conf.NewMessage()
+	msg.AddHeader("key1", "value1")
+	msg.Body = []byte("BODY#BODY##BODY")
+	msg.Generate()
+	var stream = append(append([]byte{}, msg.Data...), msg.Data...)
+	// Read one byte at a time, so the ending delimiter is split over many reads.
+	reader := bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(stream)), conf.BufSize)
+	for i := 0; i < 2; i++ {
+		newmsg, err := quickproto.ReadConn(reader, conf, nil, false)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if newmsg.Headers["key1"][0] != "value1" {
+			t.Errorf("message %d: Expected key1 to be value1", i)
+		}
+		if string(newmsg.Body) != "BODY#BODY##BODY" {
+			t.Errorf("message %d: Expected body to be BODY#BODY##BODY, got %q", i, newmsg.Body)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+func TestRegistry(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	mux := server.NewServeMux("")
+	mux.HandleFunc("echo", func(w server.ResponseWriter, req *quickproto.Message) {
+		var resp = w.NewMessage()
+		resp.Body = req.Body
+		w.Write(resp)
+	})
+	s, served := startTestServer(t, context.Background(), conf, mux)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	// Broadcast while clients connect and send requests.
+	var stop = make(chan struct{})
+	var broadcasting sync.WaitGroup
+	broadcasting.Add(1)
+	go func() {
+		defer broadcasting.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var msg = conf.NewMessage()
+			msg.AddHeader("type", "broadcast")
+			s.Broadcast(msg)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dialTestServer(t, s, conf, func(*quickproto.Message) {})
+			var req = conf.NewMessage()
+			req.AddHeader("path", "echo")
+			req.Body = []byte("ECHO")
+			if resp, err := c.Request(context.Background(), req); err != nil || string(resp.Body) != "ECHO" {
+				t.Errorf("Expected ECHO, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	broadcasting.Wait()
+
+	if s.Clients.Count() != 5 {
+		t.Fatalf("Expected 5 clients, got %d", s.Clients.Count())
+	}
+	var ids = make(map[string]bool)
+	s.Clients.Range(func(id string, client *server.Client) bool {
+		if id == "" || ids[id] || client.ID != id {
+			t.Errorf("Expected a unique ID, got %q", id)
+		}
+		ids[id] = true
+		if c, ok := s.Clients.Get(id); !ok || c != client {
+			t.Errorf("Expected Get(%q) to return the client", id)
+		}
+		return true
+	})
+	var n int
+	s.Clients.Range(func(id string, client *server.Client) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Expected Range to stop after the first client, got %d", n)
+	}
+
+	for id := range ids {
+		client, ok := s.Clients.Remove(id)
+		if !ok || client.ID != id {
+			t.Fatalf("Expected Remove(%q) to return the client", id)
+		}
+		if _, ok := s.Clients.Remove(id); ok {
+			t.Errorf("Expected %q to be removed", id)
+		}
+		// The connection is still open.
+		if err := s.RemoveClient(client.Conn); err != nil {
+			t.Error(err)
+		}
+		break
+	}
+	if s.Clients.Count() != 4 {
+		t.Errorf("Expected 4 clients, got %d", s.Clients.Count())
+	}
+	s.Shutdown(context.Background())
+	<-served
+	if s.Clients.Count() != 0 {
+		t.Errorf("Expected all clients to be removed, got %d", s.Clients.Count())
+	}
+}
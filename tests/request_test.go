@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+func TestClientRequest(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	s, sc, c := connectTestClient(t, conf)
+	var broadcasts = make(chan *quickproto.Message, 10)
+	c.OnMessage = func(msg *quickproto.Message) {
+		broadcasts <- msg
+	}
+
+	// Answer requests in reverse order, with a broadcast before every response.
+	go func() {
+		var requests []*quickproto.Message
+		for {
+			req, err := s.Read(sc)
+			if err != nil {
+				return
+			}
+			if req.Headers.Get("type") == "ignore" {
+				continue
+			}
+			requests = append(requests, req)
+			if len(requests) < 3 {
+				continue
+			}
+			for i := len(requests) - 1; i >= 0; i-- {
+				var broadcast = conf.NewMessage()
+				broadcast.AddHeader("type", "broadcast")
+				s.Write(sc, broadcast)
+				var resp = conf.NewMessage()
+				resp.ReplyTo(requests[i])
+				resp.Body = requests[i].Body
+				s.Write(sc, resp)
+			}
+			requests = nil
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var req = conf.NewMessage()
+			req.Body = []byte("REQUEST" + strconv.Itoa(i))
+			resp, err := c.Request(context.Background(), req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.CorrelationID() != req.ID() || string(resp.Body) != string(req.Body) {
+				t.Errorf("Expected the response to %s, got %s", req.Body, resp.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-broadcasts:
+			if msg.Headers.Get("type") != "broadcast" || msg.ID() == "" {
+				t.Errorf("Expected a broadcast with a message ID, got %v", msg.Headers)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected broadcasts to be passed to OnMessage")
+		}
+	}
+
+	// No response is sent.
+	c.RequestTimeout = 50 * time.Millisecond
+	var req = conf.NewMessage()
+	req.AddHeader("type", "ignore")
+	if _, err := c.Request(context.Background(), req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the request to time out, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req = conf.NewMessage()
+	req.AddHeader("type", "ignore")
+	if _, err := c.Request(ctx, req); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the request to be cancelled, got %v", err)
+	}
+
+	// The connection is closed while waiting.
+	c.RequestTimeout = 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.RemoveClient(sc.Conn)
+	}()
+	req = conf.NewMessage()
+	req.AddHeader("type", "ignore")
+	if _, err := c.Request(context.Background(), req); err == nil {
+		t.Error("Expected an error when the connection is closed")
+	}
+	if err := c.Listen(); err == nil {
+		t.Error("Expected Listen to return the read error")
+	}
+}
+
+func TestClientRequestReconnect(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	s, _ := startTestServer(t, context.Background(), conf, server.HandlerFunc(func(w server.ResponseWriter, req *quickproto.Message) {
+		var resp = w.NewMessage()
+		resp.Body = []byte("pong")
+		w.Write(resp)
+	}))
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	c := dialTestServer(t, s, conf, nil)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			c.Terminate()
+			if err := c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := c.Request(ctx, conf.NewMessage())
+		cancel()
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		if string(resp.Body) != "pong" {
+			t.Errorf("connection %d: expected pong, got %q", i, resp.Body)
+		}
+	}
+}
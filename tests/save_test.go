@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+func TestSaveTraversal(t *testing.T) {
+	var dir = t.TempDir()
+	var outside = t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	for _, name := range []string{"../file1", "a/../../file1", "/etc/file1", "..\\file1", "link/file1", ""} {
+		file := quickproto.NewMessageFile(name, []byte("FILE1"))
+		if err := file.Save(dir); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Error("Expected no files to be written outside of the directory")
+	}
+	// Subdirectories inside of the directory are allowed.
+	file := quickproto.NewMessageFile("sub/dir/file1", []byte("FILE1"))
+	if err := file.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "sub", "dir", "file1")); string(data) != "FILE1" {
+		t.Errorf("Expected FILE1, got %q", data)
+	}
+}
+
+func TestSaveOptions(t *testing.T) {
+	var dir = t.TempDir()
+	if err := quickproto.NewMessageFile("file1.txt", []byte("OLD")).Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	var file = quickproto.NewMessageFile("file1.txt", []byte("NEW"))
+	var read = func() string {
+		data, _ := os.ReadFile(filepath.Join(dir, "file1.txt"))
+		return string(data)
+	}
+	if err := file.SaveWithOptions(dir, &quickproto.SaveOptions{Overwrite: quickproto.OverwriteDeny}); err == nil {
+		t.Error("Expected an error when the file exists")
+	}
+	if err := file.SaveWithOptions(dir, &quickproto.SaveOptions{Overwrite: quickproto.OverwriteSkip}); err != nil || read() != "OLD" {
+		t.Errorf("Expected the file to be skipped, got %q (%v)", read(), err)
+	}
+	if err := file.SaveWithOptions(dir, &quickproto.SaveOptions{Atomic: true}); err != nil || read() != "NEW" {
+		t.Errorf("Expected the file to be replaced, got %q (%v)", read(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no temporary files to be left, found %d files", len(entries))
+	}
+	if err := file.SaveWithOptions(dir, &quickproto.SaveOptions{AllowedExtensions: []string{"png", ".JPG"}}); err == nil {
+		t.Error("Expected .txt not to be allowed")
+	}
+	if err := file.SaveWithOptions(dir, &quickproto.SaveOptions{AllowedExtensions: []string{"TXT"}}); err != nil {
+		t.Error(err)
+	}
+	if err := file.SaveWithOptions(dir, &quickproto.SaveOptions{MaxSize: 2}); err == nil {
+		t.Error("Expected an error when the file is larger than the maximum size")
+	}
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/client"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+func startTestServer(t *testing.T, ctx context.Context, conf *quickproto.Config, handler server.Handler) (*server.Server, chan error) {
+	s := server.New("127.0.0.1", 0, conf)
+	if _, err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	var served = make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, handler)
+	}()
+	return s, served
+}
+
+func dialTestServer(t *testing.T, s *server.Server, conf *quickproto.Config, onmessage func(*quickproto.Message)) *client.Client {
+	c := client.New("127.0.0.1", s.Listener.Addr().(*net.TCPAddr).Port, conf, onmessage)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Terminate() })
+	return c
+}
+
+func TestServeShutdown(t *testing.T) {
+	for name, conf := range pipelineConfigs() {
+		var started = make(chan struct{}, 1)
+		mux := server.NewServeMux("path")
+		mux.HandleFunc("echo", func(w server.ResponseWriter, req *quickproto.Message) {
+			var resp = w.NewMessage()
+			resp.Body = req.Body
+			w.Write(resp)
+		})
+		mux.HandleFunc("slow", func(w server.ResponseWriter, req *quickproto.Message) {
+			started <- struct{}{}
+			time.Sleep(100 * time.Millisecond)
+			var resp = w.NewMessage()
+			resp.Body = []byte("SLOW")
+			w.Write(resp)
+		})
+		s, served := startTestServer(t, context.Background(), conf, mux)
+
+		var notices = make(chan *quickproto.Message, 1)
+		slow := dialTestServer(t, s, conf, func(msg *quickproto.Message) {
+			notices <- msg
+		})
+		fast := dialTestServer(t, s, conf, nil)
+
+		var slowResp = make(chan *quickproto.Message, 1)
+		go func() {
+			var req = conf.NewMessage()
+			req.AddHeader("path", "slow")
+			resp, err := slow.Request(context.Background(), req)
+			if err != nil {
+				t.Errorf("(%s) %v", name, err)
+			}
+			slowResp <- resp
+		}()
+		<-started
+
+		// Other clients are served while the slow handler runs.
+		var req = conf.NewMessage()
+		req.AddHeader("path", "echo")
+		req.Body = []byte("ECHO")
+		resp, err := fast.Request(context.Background(), req)
+		if err != nil {
+			t.Fatalf("(%s) %v", name, err)
+		}
+		if string(resp.Body) != "ECHO" {
+			t.Errorf("(%s) Expected ECHO, got %q", name, resp.Body)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.Shutdown(ctx); err != nil {
+			t.Fatalf("(%s) %v", name, err)
+		}
+		cancel()
+		// The slow handler finished before the connections were closed.
+		if resp := <-slowResp; resp == nil || string(resp.Body) != "SLOW" {
+			t.Errorf("(%s) Expected the slow response before shutting down, got %v", name, resp)
+		}
+		select {
+		case notice := <-notices:
+			if notice.Headers.Get(quickproto.CLOSE_HEADER) != "shutdown" {
+				t.Errorf("(%s) Expected a close notice, got %v", name, notice.Headers)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("(%s) Expected a close notice", name)
+		}
+		if err := slow.Listen(); err == nil {
+			t.Errorf("(%s) Expected the connection to be closed", name)
+		}
+		if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("(%s) Expected ErrServerClosed, got %v", name, err)
+		}
+		if s.Clients.Count() != 0 {
+			t.Errorf("(%s) Expected all clients to be removed, got %d", name, s.Clients.Count())
+		}
+		if err := s.Serve(context.Background(), mux); !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("(%s) Expected Serve to fail after Shutdown, got %v", name, err)
+		}
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	s, served := startTestServer(t, ctx, conf, server.NewServeMux(""))
+	c := dialTestServer(t, s, conf, nil)
+	var req = conf.NewMessage()
+	req.AddHeader("path", "missing")
+	if _, err := c.Request(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if err := c.Listen(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	var release = make(chan struct{})
+	var finished = make(chan struct{})
+	var handler = server.Timeout(20 * time.Millisecond)(server.HandlerFunc(func(w server.ResponseWriter, req *quickproto.Message) {
+		<-release
+		close(finished)
+	}))
+	s, served := startTestServer(t, context.Background(), conf, handler)
+	c := dialTestServer(t, s, conf, nil)
+	resp, err := c.Request(context.Background(), conf.NewMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Headers.Get(server.STATUS_HEADER) != "504" {
+		t.Fatalf("Expected a timeout error, got %v", resp.Headers)
+	}
+
+	// Shutdown waits for the handler which timed out.
+	var shutdown = make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for the handler, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Expected the handler to return before Shutdown")
+	}
+	if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/client"
+	"github.com/Nigel2392/quickproto/transfer"
+)
+
+// Conn which drops the connection after a number of writes.
+type droppingConn struct {
+	transfer.Conn
+	client *client.Client
+	writes int
+}
+
+func (d *droppingConn) Write(msg *quickproto.Message) error {
+	if d.writes == 0 {
+		d.client.Terminate()
+		return errors.New("connection dropped")
+	}
+	d.writes--
+	return d.Conn.Write(msg)
+}
+
+func writeTransferFile(t *testing.T, size int) (string, []byte) {
+	var data = []byte(strings.Repeat("TRANSFER&&&&&&&&DATA", size/20))
+	var path = filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestTransferUpload(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	var opts = &transfer.Options{ChunkSize: 1000}
+	path, data := writeTransferFile(t, 10000)
+	var dest = t.TempDir()
+
+	// Drop the connection after the offer and 3 chunks.
+	s, sc, c := connectTestClient(t, conf)
+	var received = make(chan error, 1)
+	go func() {
+		_, err := transfer.Receive(transfer.ServerConn(s, sc), dest, opts)
+		received <- err
+	}()
+	if err := transfer.Send(&droppingConn{Conn: transfer.ClientConn(c), client: c, writes: 4}, path, opts); err == nil {
+		t.Fatal("Expected the transfer to fail")
+	}
+	if err := <-received; err == nil {
+		t.Fatal("Expected the receiver to fail")
+	}
+
+	// Reconnect, and resume.
+	s, sc, c = connectTestClient(t, conf)
+	go func() {
+		_, err := transfer.Receive(transfer.ServerConn(s, sc), dest, nil)
+		received <- err
+	}()
+	var first = int64(-1)
+	err := transfer.Send(transfer.ClientConn(c), path, &transfer.Options{ChunkSize: 1000, Progress: func(offset, size int64) {
+		if first < 0 {
+			first = offset
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if first != 3000 {
+		t.Errorf("Expected the transfer to resume at 3000, got %d", first)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, "upload.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the received file to be equal to the sent file (%v)", err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 1 {
+		t.Errorf("Expected the partial file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestTransferSpilledChunks(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	conf.SpillThreshold = 100
+	conf.SpillDir = t.TempDir()
+	path, data := writeTransferFile(t, 5000)
+	var dest = t.TempDir()
+	s, sc, c := connectTestClient(t, conf)
+	var received = make(chan error, 1)
+	go func() {
+		_, err := transfer.Receive(transfer.ServerConn(s, sc), dest, nil)
+		received <- err
+	}()
+	if err := transfer.Send(transfer.ClientConn(c), path, &transfer.Options{ChunkSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "upload.bin")); !bytes.Equal(got, data) {
+		t.Error("Expected the received file to be equal to the sent file")
+	}
+	if entries, _ := os.ReadDir(conf.SpillDir); len(entries) != 0 {
+		t.Errorf("Expected the spilled chunks to be removed, found %d files", len(entries))
+	}
+}
+
+func TestTransferDownload(t *testing.T) {
+	conf := quickproto.NewConfig([]byte("&"), false, false, 4096, nil, nil)
+	path, data := writeTransferFile(t, 5000)
+	s, sc, c := connectTestClient(t, conf)
+	var served = make(chan error, 1)
+	go func() {
+		var conn = transfer.ServerConn(s, sc)
+		for i := 0; i < 2; i++ {
+			msg, err := conn.Read()
+			if err != nil {
+				served <- err
+				return
+			}
+			transfer.Serve(conn, msg, filepath.Dir(path), nil)
+		}
+		served <- nil
+	}()
+	var dest = t.TempDir()
+	received, err := transfer.Request(transfer.ClientConn(c), "upload.bin", dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(received); !bytes.Equal(got, data) {
+		t.Error("Expected the downloaded file to be equal to the served file")
+	}
+	if _, err := transfer.Request(transfer.ClientConn(c), "../upload.bin", dest, nil); err == nil {
+		t.Error("Expected requesting a file outside of the root to fail")
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
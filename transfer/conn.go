@@ -0,0 +1,45 @@
+package transfer
+
+import (
+	"github.com/Nigel2392/quickproto"
+	"github.com/Nigel2392/quickproto/client"
+	"github.com/Nigel2392/quickproto/server"
+)
+
+// Conn is a connection to send transfer messages over.
+// The connection should not be used for other messages while a transfer is running.
+type Conn interface {
+	// Create a new message for the connection.
+	NewMessage() *quickproto.Message
+	// Read the next message.
+	Read() (*quickproto.Message, error)
+	// Write a message.
+	Write(msg *quickproto.Message) error
+}
+
+// ClientConn returns the Conn of a client, to transfer files to and from the server.
+func ClientConn(c *client.Client) Conn {
+	return &clientConn{c: c}
+}
+
+// ServerConn returns the Conn of a client connected to a server, to transfer files to and from the client.
+func ServerConn(s *server.Server, c *server.Client) Conn {
+	return &serverConn{s: s, c: c}
+}
+
+type clientConn struct {
+	c *client.Client
+}
+
+func (c *clientConn) NewMessage() *quickproto.Message     { return c.c.CONFIG.NewMessage() }
+func (c *clientConn) Read() (*quickproto.Message, error)  { return c.c.Read() }
+func (c *clientConn) Write(msg *quickproto.Message) error { return c.c.Write(msg) }
+
+type serverConn struct {
+	s *server.Server
+	c *server.Client
+}
+
+func (c *serverConn) NewMessage() *quickproto.Message     { return c.s.CONFIG.NewMessage() }
+func (c *serverConn) Read() (*quickproto.Message, error)  { return c.s.Read(c.c) }
+func (c *serverConn) Write(msg *quickproto.Message) error { return c.s.Write(c.c, msg) }
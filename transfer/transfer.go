@@ -0,0 +1,367 @@
+// Package transfer sends files in chunks over a quickproto connection.
+//
+// A transfer is resumable: the receiver keeps the data it received in a partial file,
+// and tells the sender where to continue when the file is sent again, after a reconnect.
+// The SHA-256 checksum of the whole file is checked when all chunks are received.
+//
+// Messages of a transfer:
+//
+//	sender   -> receiver: offer    (id, name, size, sha256, chunk size)
+//	receiver -> sender:   accept   (offset to continue from)
+//	sender   -> receiver: chunk    (offset, data)
+//	receiver -> sender:   ack      (offset of the received data, written to disk)
+//	sender   -> receiver: done
+//	receiver -> sender:   complete, or error when the checksum does not match
+//
+// Files can be uploaded and downloaded: Send and Receive work in both directions,
+// Request asks the other side to send a file, which it handles with Serve.
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Nigel2392/quickproto"
+)
+
+// Headers of transfer messages.
+const (
+	TYPE_HEADER       = "q-transfer"
+	ID_HEADER         = "q-transfer-id"
+	NAME_HEADER       = "q-transfer-name"
+	SIZE_HEADER       = "q-transfer-size"
+	CHECKSUM_HEADER   = "q-transfer-sha256"
+	CHUNK_SIZE_HEADER = "q-transfer-chunk-size"
+	OFFSET_HEADER     = "q-transfer-offset"
+	ERROR_HEADER      = "q-transfer-error"
+)
+
+// Types of transfer messages.
+const (
+	TYPE_REQUEST  = "request"
+	TYPE_OFFER    = "offer"
+	TYPE_ACCEPT   = "accept"
+	TYPE_CHUNK    = "chunk"
+	TYPE_ACK      = "ack"
+	TYPE_DONE     = "done"
+	TYPE_COMPLETE = "complete"
+	TYPE_ERROR    = "error"
+)
+
+// Default size of chunks.
+const DEFAULT_CHUNK_SIZE = 1024 * 1024
+
+// Name of the file in chunk messages.
+const chunkFile = "chunk"
+
+// Options for a transfer.
+type Options struct {
+	// Size of the chunks sent, DEFAULT_CHUNK_SIZE if 0.
+	ChunkSize int
+	// Called after every acknowledged chunk, with the number of bytes the receiver has.
+	Progress func(offset int64, size int64)
+}
+
+func (o *Options) chunkSize() int {
+	if o == nil || o.ChunkSize <= 0 {
+		return DEFAULT_CHUNK_SIZE
+	}
+	return o.ChunkSize
+}
+
+func (o *Options) progress(offset int64, size int64) {
+	if o != nil && o.Progress != nil {
+		o.Progress(offset, size)
+	}
+}
+
+// Send a file to the other side of the connection, which receives it with Receive.
+// When the receiver already has a part of the file, sending continues from there.
+func Send(conn Conn, path string, opts *Options) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var hash = sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	var checksum = hex.EncodeToString(hash.Sum(nil))
+	var size = info.Size()
+	// The same file gets the same id, so the receiver can find what it already has.
+	var id = checksum[:16]
+
+	var offer = newMessage(conn, TYPE_OFFER, id)
+	if err := offer.AddHeader(NAME_HEADER, filepath.Base(path)); err != nil {
+		return err
+	}
+	offer.AddHeader(SIZE_HEADER, strconv.FormatInt(size, 10))
+	offer.AddHeader(CHECKSUM_HEADER, checksum)
+	offer.AddHeader(CHUNK_SIZE_HEADER, strconv.Itoa(opts.chunkSize()))
+	if err := conn.Write(offer); err != nil {
+		return err
+	}
+	accept, err := expect(conn, TYPE_ACCEPT, id)
+	if err != nil {
+		return err
+	}
+	offset, err := accept.Headers.GetInt(OFFSET_HEADER)
+	if err != nil || offset < 0 || int64(offset) > size {
+		return errors.New("invalid offset in accept message")
+	}
+	opts.progress(int64(offset), size)
+
+	var buf = make([]byte, opts.chunkSize())
+	for pos := int64(offset); pos < size; {
+		n, err := f.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var chunk = newMessage(conn, TYPE_CHUNK, id)
+		chunk.AddHeader(OFFSET_HEADER, strconv.FormatInt(pos, 10))
+		chunk.AddRawFile(chunkFile, buf[:n])
+		if err := conn.Write(chunk); err != nil {
+			return err
+		}
+		ack, err := expect(conn, TYPE_ACK, id)
+		if err != nil {
+			return err
+		}
+		acked, err := ack.Headers.GetInt(OFFSET_HEADER)
+		if err != nil || int64(acked) != pos+int64(n) {
+			return errors.New("invalid offset in ack message")
+		}
+		pos = int64(acked)
+		opts.progress(pos, size)
+	}
+	if err := conn.Write(newMessage(conn, TYPE_DONE, id)); err != nil {
+		return err
+	}
+	_, err = expect(conn, TYPE_COMPLETE, id)
+	return err
+}
+
+// Receive a file sent with Send, and save it in dir.
+// Returns the path of the received file.
+//
+// Received data is kept in a partial file in dir, named after the file and its id.
+// When the transfer is interrupted, sending the file again continues from the end of the partial file.
+func Receive(conn Conn, dir string, opts *Options) (string, error) {
+	offer, err := expect(conn, TYPE_OFFER, "")
+	if err != nil {
+		return "", err
+	}
+	return receive(conn, offer, dir, opts)
+}
+
+// Request a file from the other side of the connection, which handles it with Serve.
+// The file is received like with Receive.
+func Request(conn Conn, name string, dir string, opts *Options) (string, error) {
+	var request = newMessage(conn, TYPE_REQUEST, "")
+	if err := request.AddHeader(NAME_HEADER, name); err != nil {
+		return "", err
+	}
+	if err := conn.Write(request); err != nil {
+		return "", err
+	}
+	return Receive(conn, dir, opts)
+}
+
+// Serve a request message, sent with Request, by sending the requested file from root.
+// Only files directly in root can be requested.
+func Serve(conn Conn, request *quickproto.Message, root string, opts *Options) error {
+	if request.Headers.Get(TYPE_HEADER) != TYPE_REQUEST {
+		return errors.New("message is not a transfer request")
+	}
+	name, err := checkName(request.Headers.Get(NAME_HEADER))
+	if err != nil {
+		return sendError(conn, "", err)
+	}
+	var path = filepath.Join(root, name)
+	if _, err := os.Stat(path); err != nil {
+		return sendError(conn, "", errors.New("file "+name+" not found"))
+	}
+	return Send(conn, path, opts)
+}
+
+// Receive the chunks of an offered file.
+func receive(conn Conn, offer *quickproto.Message, dir string, opts *Options) (string, error) {
+	var id = offer.Headers.Get(ID_HEADER)
+	name, err := checkName(offer.Headers.Get(NAME_HEADER))
+	if err != nil {
+		return "", sendError(conn, id, err)
+	}
+	size, err := strconv.ParseInt(offer.Headers.Get(SIZE_HEADER), 10, 64)
+	if err != nil || size < 0 {
+		return "", sendError(conn, id, errors.New("invalid size"))
+	}
+	var checksum = offer.Headers.Get(CHECKSUM_HEADER)
+	if _, err := checkName(id); err != nil {
+		return "", sendError(conn, id, errors.New("invalid id"))
+	}
+	var part_path = filepath.Join(dir, name+"."+id+".part")
+	part, err := os.OpenFile(part_path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", sendError(conn, id, err)
+	}
+	defer part.Close()
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", sendError(conn, id, err)
+	}
+	if offset > size {
+		// Not the file we thought it was, start over.
+		if err := part.Truncate(0); err != nil {
+			return "", sendError(conn, id, err)
+		}
+		offset = 0
+	}
+	var accept = newMessage(conn, TYPE_ACCEPT, id)
+	accept.AddHeader(OFFSET_HEADER, strconv.FormatInt(offset, 10))
+	if err := conn.Write(accept); err != nil {
+		return "", err
+	}
+	opts.progress(offset, size)
+
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return "", err
+		}
+		if msg.Headers.Get(ID_HEADER) != id {
+			return "", sendError(conn, id, errors.New("unexpected transfer id"))
+		}
+		switch msg.Headers.Get(TYPE_HEADER) {
+		case TYPE_CHUNK:
+			chunk_offset, err := msg.Headers.GetInt(OFFSET_HEADER)
+			if err != nil || int64(chunk_offset) != offset || msg.Files[chunkFile] == nil {
+				return "", sendError(conn, id, errors.New("unexpected chunk"))
+			}
+			n, err := writeChunk(part, msg.Files[chunkFile], offset, size)
+			msg.Close()
+			if err != nil {
+				return "", sendError(conn, id, err)
+			}
+			// Only acknowledge data which is on disk.
+			if err := part.Sync(); err != nil {
+				return "", sendError(conn, id, err)
+			}
+			offset += n
+			var ack = newMessage(conn, TYPE_ACK, id)
+			ack.AddHeader(OFFSET_HEADER, strconv.FormatInt(offset, 10))
+			if err := conn.Write(ack); err != nil {
+				return "", err
+			}
+			opts.progress(offset, size)
+		case TYPE_DONE:
+			return finish(conn, part, part_path, filepath.Join(dir, name), id, size, checksum)
+		case TYPE_ERROR:
+			return "", errors.New("transfer failed: " + msg.Headers.Get(ERROR_HEADER))
+		default:
+			return "", sendError(conn, id, errors.New("unexpected message "+msg.Headers.Get(TYPE_HEADER)))
+		}
+	}
+}
+
+// Write a received chunk to the partial file at the offset.
+// The chunk is copied through Open, so chunks spilled to a temporary file are never read into memory.
+func writeChunk(part *os.File, chunk *quickproto.MessageFile, offset int64, size int64) (int64, error) {
+	if offset+int64(chunk.Size()) > size {
+		return 0, errors.New("file is larger than offered")
+	}
+	r, err := chunk.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(part, r)
+}
+
+// Check the size and checksum of a received file, and move it to its final path.
+func finish(conn Conn, part *os.File, part_path string, path string, id string, size int64, checksum string) (string, error) {
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return "", sendError(conn, id, err)
+	}
+	var hash = sha256.New()
+	n, err := io.Copy(hash, part)
+	if err != nil {
+		return "", sendError(conn, id, err)
+	}
+	if n != size || hex.EncodeToString(hash.Sum(nil)) != checksum {
+		// The partial file is useless, remove it so the next transfer starts over.
+		part.Close()
+		os.Remove(part_path)
+		return "", sendError(conn, id, errors.New("checksum mismatch"))
+	}
+	if err := part.Close(); err != nil {
+		return "", sendError(conn, id, err)
+	}
+	if err := os.Rename(part_path, path); err != nil {
+		return "", sendError(conn, id, err)
+	}
+	return path, conn.Write(newMessage(conn, TYPE_COMPLETE, id))
+}
+
+// Create a transfer message.
+func newMessage(conn Conn, typ string, id string) *quickproto.Message {
+	var msg = conn.NewMessage()
+	msg.Headers.Set(TYPE_HEADER, typ)
+	if id != "" {
+		msg.Headers.Set(ID_HEADER, id)
+	}
+	return msg
+}
+
+// Read the next message, and check that it is of the expected type.
+// Error messages of the other side are returned as errors.
+func expect(conn Conn, typ string, id string) (*quickproto.Message, error) {
+	msg, err := conn.Read()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.Headers.Get(TYPE_HEADER) == TYPE_ERROR:
+		return nil, errors.New("transfer failed: " + msg.Headers.Get(ERROR_HEADER))
+	case msg.Headers.Get(TYPE_HEADER) != typ:
+		return nil, errors.New("expected " + typ + " message, got " + msg.Headers.Get(TYPE_HEADER))
+	case id != "" && msg.Headers.Get(ID_HEADER) != id:
+		return nil, errors.New("unexpected transfer id")
+	}
+	return msg, nil
+}
+
+// Tell the other side the transfer failed, and return the error.
+func sendError(conn Conn, id string, err error) error {
+	var msg = newMessage(conn, TYPE_ERROR, id)
+	// Headers cannot contain the delimiter, unless escaping is enabled.
+	msg.Headers.Set(ERROR_HEADER, strings.Map(func(r rune) rune {
+		if strings.ContainsRune(string(msg.Delimiter), r) {
+			return ' '
+		}
+		return r
+	}, err.Error()))
+	conn.Write(msg)
+	return err
+}
+
+// Check that a name sent by the other side is a plain file name.
+func checkName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return "", errors.New("invalid file name " + strconv.Quote(name))
+	}
+	return name, nil
+}